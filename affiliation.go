@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+)
+
+// EduPersonAffiliations is the controlled vocabulary of eduPersonAffiliation
+var EduPersonAffiliations = []string{
+	"faculty",
+	"student",
+	"staff",
+	"alum",
+	"member",
+	"affiliate",
+	"employee",
+	"library-walk-in",
+}
+
+// AffiliationPolicy determines which affiliation values a user gets, and how
+type AffiliationPolicy struct {
+	StripScope bool     // Remove the scope from scoped affiliations, e.g. staff@jhu.edu becomes staff
+	Allowed    []string // Affiliations (without scope) to keep, case insensitive.  All if empty.
+}
+
+// Apply filters and transforms affiliation values according to the policy,
+// dropping any duplicates
+func (p AffiliationPolicy) Apply(values []string) []string {
+	allowed := map[string]bool{}
+	for _, a := range p.Allowed {
+		allowed[strings.ToLower(a)] = true
+	}
+
+	var affiliations []string
+	seen := map[string]bool{}
+
+	for _, val := range values {
+		unscoped := val
+		if i := strings.LastIndex(val, "@"); i >= 0 {
+			unscoped = val[:i]
+		}
+
+		if len(allowed) > 0 && !allowed[strings.ToLower(unscoped)] {
+			continue
+		}
+
+		if p.StripScope {
+			val = unscoped
+		}
+
+		if !seen[val] {
+			seen[val] = true
+			affiliations = append(affiliations, val)
+		}
+	}
+
+	return affiliations
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AttributeMapping maps a User JSON property to the headers it is read from,
+// e.g.
+//
+//	{"property": "email", "headers": ["Mail", "Eppn"], "transforms": [{"type": "lowercase"}], "required": true}
+//
+// The headers are fallbacks; the first to give any values after transforms is
+// used.  Single-valued properties take the first value.
+type AttributeMapping struct {
+	Property   string               `json:"property"`             // User JSON property, e.g. displayName
+	Headers    []string             `json:"headers"`              // Source headers, in order of preference
+	Transforms []AttributeTransform `json:"transforms,omitempty"` // Applied to each value, in order
+	Required   bool                 `json:"required,omitempty"`   // Deny an identity to users without a value
+}
+
+// AttributeTransform transforms header values.  Values that become empty are
+// dropped.
+type AttributeTransform struct {
+	Type      string `json:"type"`                // lowercase, trim, split, or regex
+	Delimiter string `json:"delimiter,omitempty"` // For split, the delimiter between values, default ,
+	Pattern   string `json:"pattern,omitempty"`   // For regex, extracts the first group (or whole match). Non-matching values are dropped.
+
+	re *regexp.Regexp
+}
+
+// AttributeMappings configures how User properties are read from headers.
+// Properties that are mapped replace those given by ShibHeaders.
+//
+//	{
+//	  "attributes": [
+//	    {"property": "email", "headers": ["Mail"], "transforms": [{"type": "lowercase"}], "required": true},
+//	    {"property": "username", "headers": ["Eppn"], "transforms": [{"type": "regex", "pattern": "^([^@]+)@"}]}
+//	  ]
+//	}
+type AttributeMappings struct {
+	Attributes []AttributeMapping `json:"attributes"`
+}
+
+// userProperties are the User JSON properties that may be mapped, and how each
+// is set from its values
+var userProperties = map[string]func(u *User, values []string){
+	"username":    func(u *User, values []string) { u.Username = values[0] },
+	"firstName":   func(u *User, values []string) { u.Firstname = values[0] },
+	"middleName":  func(u *User, values []string) { u.Middlename = values[0] },
+	"lastName":    func(u *User, values []string) { u.Lastname = values[0] },
+	"displayName": func(u *User, values []string) { u.Displayname = values[0] },
+	"email":       func(u *User, values []string) { u.Email = values[0] },
+	"orcidId":     func(u *User, values []string) { u.OrcidID = values[0] },
+	"affiliation": func(u *User, values []string) { u.Affiliation = values },
+	"locatorIds":  func(u *User, values []string) { u.Locatorids = values },
+}
+
+// LoadAttributeMappings reads JSON attribute mappings from the given file
+func LoadAttributeMappings(path string) (*AttributeMappings, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open attribute mapping file")
+	}
+	defer f.Close()
+
+	mappings, err := ReadAttributeMappings(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read attribute mapping file %s", path)
+	}
+
+	return mappings, nil
+}
+
+// ReadAttributeMappings decodes and compiles JSON attribute mappings
+func ReadAttributeMappings(r io.Reader) (*AttributeMappings, error) {
+	var mappings AttributeMappings
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&mappings); err != nil {
+		return nil, errors.Wrapf(err, "malformed attribute mappings")
+	}
+
+	if err := mappings.Compile(); err != nil {
+		return nil, err
+	}
+
+	return &mappings, nil
+}
+
+// Compile validates the mappings and compiles any regex transforms.  Mappings
+// constructed in code must be compiled before use.
+func (m *AttributeMappings) Compile() error {
+	mapped := map[string]bool{}
+
+	for i := range m.Attributes {
+		mapping := &m.Attributes[i]
+
+		if _, ok := userProperties[mapping.Property]; !ok {
+			return errors.Errorf("attribute %d maps unknown property '%s'", i, mapping.Property)
+		}
+		if mapped[mapping.Property] {
+			return errors.Errorf("attribute %d maps %s more than once", i, mapping.Property)
+		}
+		mapped[mapping.Property] = true
+
+		if len(mapping.Headers) == 0 {
+			return errors.Errorf("attribute %d (%s) has no headers", i, mapping.Property)
+		}
+
+		for j := range mapping.Transforms {
+			if err := mapping.Transforms[j].compile(); err != nil {
+				return errors.Wrapf(err, "attribute %d (%s) transform %d", i, mapping.Property, j)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Mapped determines if the given property is mapped
+func (m *AttributeMappings) Mapped(property string) bool {
+	if m == nil {
+		return false
+	}
+
+	for _, mapping := range m.Attributes {
+		if mapping.Property == property {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Mappings gives the attribute mappings equivalent to the header definitions
+func (defs ShibHeaders) Mappings() []AttributeMapping {
+	affiliation := defs.Affiliation
+	if affiliation == nil {
+		affiliation = DefaultShibHeaders.Affiliation
+	}
+
+	return []AttributeMapping{
+		{Property: "displayName", Headers: []string{oneOf(defs.Displayname, DefaultShibHeaders.Displayname)}},
+		{Property: "firstName", Headers: []string{oneOf(defs.GivenName, DefaultShibHeaders.GivenName)}},
+		{Property: "middleName", Headers: []string{oneOf(defs.Middlename, DefaultShibHeaders.Middlename)}},
+		{Property: "lastName", Headers: []string{oneOf(defs.LastName, DefaultShibHeaders.LastName)}},
+		{Property: "email", Headers: []string{oneOf(defs.Email, DefaultShibHeaders.Email)}},
+		{Property: "username", Headers: []string{oneOf(defs.Username, DefaultShibHeaders.Username)}},
+		{Property: "orcidId", Headers: []string{oneOf(defs.OrcidID, DefaultShibHeaders.OrcidID)}},
+		{Property: "affiliation", Headers: affiliation},
+	}
+}
+
+// apply sets the mapped property of the user from the headers
+func (m AttributeMapping) apply(user *User, headers HeaderProvider, values ValueParser) error {
+	for _, header := range m.Headers {
+		vals := values.Split(headers.Get(header))
+		for _, t := range m.Transforms {
+			vals = t.apply(vals)
+		}
+
+		if len(vals) > 0 {
+			userProperties[m.Property](user, vals)
+			return nil
+		}
+	}
+
+	if m.Required {
+		return ErrorBadInput(fmt.Sprintf("Missing required %s, from headers %s", m.Property, strings.Join(m.Headers, ", ")))
+	}
+
+	return nil
+}
+
+func (t *AttributeTransform) compile() error {
+	switch t.Type {
+	case "lowercase", "trim", "split":
+	case "regex":
+		re, err := regexp.Compile(t.Pattern)
+		if err != nil {
+			return errors.Wrapf(err, "bad regex")
+		}
+		t.re = re
+	default:
+		return errors.Errorf("unknown transform type '%s'", t.Type)
+	}
+
+	return nil
+}
+
+func (t AttributeTransform) apply(values []string) []string {
+	var result []string
+
+	add := func(val string) {
+		if val != "" {
+			result = append(result, val)
+		}
+	}
+
+	for _, val := range values {
+		switch t.Type {
+		case "lowercase":
+			add(strings.ToLower(val))
+		case "trim":
+			add(strings.TrimSpace(val))
+		case "split":
+			for _, v := range strings.Split(val, oneOf(t.Delimiter, ",")) {
+				add(strings.TrimSpace(v))
+			}
+		case "regex":
+			match := t.re.FindStringSubmatch(val)
+			switch {
+			case match == nil:
+			case len(match) > 1:
+				add(match[1])
+			default:
+				add(match[0])
+			}
+		}
+	}
+
+	return result
+}
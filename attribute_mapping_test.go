@@ -0,0 +1,153 @@
+package main_test
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestAttributeMappings(t *testing.T) {
+	mappings, err := jhuda.LoadAttributeMappings("testdata/attributes.json")
+	if err != nil {
+		t.Fatalf("Could not load attribute mappings: %v", err)
+	}
+
+	cases := map[string]struct {
+		headers  map[string][]string
+		expected jhuda.User
+		invalid  bool
+	}{
+		"all mapped": {
+			headers: map[string][]string{
+				"Eppn":        {"JDoe1@jhu.edu"},
+				"Mail":        {"John.Doe@JHU.edu"},
+				"Cn":          {"John Doe"},
+				"Displayname": {"Johnny"},
+				"Roles":       {"Staff, Faculty;Member"},
+				"Sn":          {"Doe"},
+			},
+			expected: jhuda.User{
+				Username:    "JDoe1",
+				Email:       "john.doe@jhu.edu",
+				Displayname: "John Doe",
+				Lastname:    "Doe",
+				Affiliation: []string{"staff", "faculty", "member"},
+			},
+		},
+		"fallback headers": {
+			headers: map[string][]string{
+				"Eppn":        {"JDoe1@jhu.edu"},
+				"Displayname": {"Johnny"},
+			},
+			expected: jhuda.User{
+				Username:    "JDoe1",
+				Email:       "jdoe1@jhu.edu",
+				Displayname: "Johnny",
+			},
+		},
+		"unmapped properties use header definitions": {
+			headers: map[string][]string{
+				"Eppn":        {"jdoe1@jhu.edu"},
+				"Affiliation": {"staff@jhu.edu"},
+				"Givenname":   {"John"},
+			},
+			expected: jhuda.User{
+				Username:  "jdoe1",
+				Email:     "jdoe1@jhu.edu",
+				Firstname: "John",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			user, err := jhuda.UserService{
+				Attributes: mappings,
+				HeaderDefs: jhuda.ShibHeaders{LocatorIDs: []string{}},
+			}.FromHeaders(http.Header(tc.headers))
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+
+			tc.expected.ID = user.Eppn
+			tc.expected.Eppn = user.Eppn
+			tc.expected.Type = "User"
+			diffs := deep.Equal(*user, tc.expected)
+			if len(diffs) > 0 {
+				t.Fatalf("Did not get expected user:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+func TestRequiredAttribute(t *testing.T) {
+	mappings, err := jhuda.ReadAttributeMappings(strings.NewReader(`{"attributes": [
+		{"property": "email", "headers": ["Mail"], "transforms": [{"type": "regex", "pattern": "^.+@jhu\\.edu$"}], "required": true}
+	]}`))
+	if err != nil {
+		t.Fatalf("Could not read attribute mappings: %v", err)
+	}
+
+	us := jhuda.UserService{Attributes: mappings}
+
+	_, err = us.FromHeaders(http.Header{"Eppn": {"foo@jhu.edu"}, "Mail": {"foo@example.org"}})
+	var badInput jhuda.ErrorBadInput
+	if !errors.As(err, &badInput) {
+		t.Fatalf("Expected bad input error for a missing required attribute, got %v", err)
+	}
+
+	user, err := us.FromHeaders(http.Header{"Eppn": {"foo@jhu.edu"}, "Mail": {"foo@jhu.edu"}})
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+	if user.Email != "foo@jhu.edu" {
+		t.Fatalf("Got email %s, but expected foo@jhu.edu", user.Email)
+	}
+}
+
+func TestLocatorIDMapping(t *testing.T) {
+	mappings, err := jhuda.ReadAttributeMappings(strings.NewReader(`{"attributes": [
+		{"property": "locatorIds", "headers": ["Employeenumber"], "transforms": [{"type": "regex", "pattern": "^0*(\\d+)$"}]}
+	]}`))
+	if err != nil {
+		t.Fatalf("Could not read attribute mappings: %v", err)
+	}
+
+	user, err := jhuda.UserService{Attributes: mappings}.FromHeaders(http.Header{
+		"Eppn":           {"foo@jhu.edu"},
+		"Employeenumber": {"000123;abc;0456"},
+	})
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+
+	diffs := deep.Equal(user.Locatorids, []string{"123", "456"})
+	if len(diffs) > 0 {
+		t.Fatalf("Did not get expected locators:\n%s", strings.Join(diffs, "\n"))
+	}
+}
+
+func TestBadAttributeMappings(t *testing.T) {
+	cases := map[string]string{
+		"unknown property":  `{"attributes": [{"property": "roles", "headers": ["Roles"]}]}`,
+		"mapped twice":      `{"attributes": [{"property": "email", "headers": ["Mail"]}, {"property": "email", "headers": ["Email"]}]}`,
+		"no headers":        `{"attributes": [{"property": "email"}]}`,
+		"unknown transform": `{"attributes": [{"property": "email", "headers": ["Mail"], "transforms": [{"type": "reverse"}]}]}`,
+		"bad regex":         `{"attributes": [{"property": "email", "headers": ["Mail"], "transforms": [{"type": "regex", "pattern": "("}]}]}`,
+		"unknown field":     `{"attributes": [{"property": "email", "headers": ["Mail"], "default": "x"}]}`,
+	}
+
+	for name, config := range cases {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			if _, err := jhuda.ReadAttributeMappings(strings.NewReader(config)); err == nil {
+				t.Fatalf("Expected an error reading mappings")
+			}
+		})
+	}
+}
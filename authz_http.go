@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// RequiredRolesHeader is a request header listing (comma-separated) roles
+// required by the /authz endpoint, in addition to any role query parameters
+const RequiredRolesHeader = "X-Required-Roles"
+
+// httpAuthzService decides whether the current user has all required roles, so
+// that a reverse proxy can gate access on roles.  Required roles are given as
+// role query parameters (e.g. /authz?role=admin&role=submitter), or in the
+// X-Required-Roles header.
+//
+// Responds 200 with the user if allowed, 403 if the user lacks a required role,
+// and 401 if there is no usable identity.  Errors are problem+json.
+func httpAuthzService(svc userProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, err := svc.FromHeaders(r.Header)
+		if err != nil {
+			writeProblem(w, authProblem(err))
+			return
+		}
+
+		if missing := missingRoles(user, requiredRoles(r)); len(missing) > 0 {
+			writeProblem(w, missingRolesProblem(user, missing))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json;charset=utf-8")
+		err = user.Serialize(w)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Error encoding JSON response %v", err)
+		}
+	})
+}
+
+// requiredRoles collects the roles required by the request
+func requiredRoles(r *http.Request) []string {
+	var roles []string
+
+	for _, role := range r.URL.Query()["role"] {
+		roles = append(roles, splitList(role)...)
+	}
+
+	for _, header := range r.Header[http.CanonicalHeaderKey(RequiredRolesHeader)] {
+		roles = append(roles, splitList(header)...)
+	}
+
+	return roles
+}
+
+func missingRolesProblem(user *User, missing []string) Problem {
+	return Problem{
+		Type:   ProblemMissingRoles,
+		Title:  "Missing roles",
+		Status: http.StatusForbidden,
+		Detail: fmt.Sprintf("%s does not have required roles: %s", user.ID, strings.Join(missing, ", ")),
+	}
+}
+
+// missingRoles finds the required roles the user does not have
+func missingRoles(user *User, required []string) []string {
+	has := map[string]bool{}
+	for _, role := range user.Roles {
+		has[role] = true
+	}
+
+	var missing []string
+	for _, role := range required {
+		if !has[role] {
+			missing = append(missing, role)
+		}
+	}
+
+	return missing
+}
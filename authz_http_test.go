@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthz(t *testing.T) {
+	user := &User{
+		ID:    "foo@example.org",
+		Roles: []string{"submitter", "admin"},
+	}
+
+	cases := map[string]struct {
+		url          string
+		header       string
+		err          error
+		expectedCode int
+	}{
+		"no required roles": {
+			url:          "/authz",
+			expectedCode: http.StatusOK,
+		},
+		"has role": {
+			url:          "/authz?role=admin",
+			expectedCode: http.StatusOK,
+		},
+		"has all roles": {
+			url:          "/authz?role=admin&role=submitter",
+			expectedCode: http.StatusOK,
+		},
+		"comma separated roles": {
+			url:          "/authz?role=admin,submitter",
+			expectedCode: http.StatusOK,
+		},
+		"lacks role": {
+			url:          "/authz?role=admin&role=reviewer",
+			expectedCode: http.StatusForbidden,
+		},
+		"has header role": {
+			url:          "/authz",
+			header:       "admin, submitter",
+			expectedCode: http.StatusOK,
+		},
+		"lacks header role": {
+			url:          "/authz?role=admin",
+			header:       "reviewer",
+			expectedCode: http.StatusForbidden,
+		},
+		"no identity": {
+			url:          "/authz?role=admin",
+			err:          ErrorBadInput("No eppn"),
+			expectedCode: http.StatusUnauthorized,
+		},
+		"internal error": {
+			url:          "/authz?role=admin",
+			err:          errors.New("Boooo"),
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			if tc.header != "" {
+				req.Header.Set(RequiredRolesHeader, tc.header)
+			}
+
+			resp := httptest.NewRecorder()
+			httpAuthzService(FakeUserProvider(func() (*User, error) {
+				if tc.err != nil {
+					return nil, tc.err
+				}
+				return user, nil
+			})).ServeHTTP(resp, req)
+
+			if resp.Code != tc.expectedCode {
+				t.Fatalf("Got code %d, but expected %d: %s", resp.Code, tc.expectedCode, resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthzMethodNotAllowed(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodDelete, http.MethodPut} {
+		resp := httptest.NewRecorder()
+		httpAuthzService(nil).ServeHTTP(resp, httptest.NewRequest(method, "/authz", nil))
+
+		if resp.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Method should not be allowed: %s", method)
+		}
+	}
+}
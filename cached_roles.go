@@ -0,0 +1,158 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CachedRoles caches the roles found by another lookup, keyed by User.ID.  It is
+// meant for expensive lookups (e.g. LDAP or remote services) whose results only
+// depend on who the user is.
+//
+// At most MaxSize users are cached, evicting the least recently used.  Concurrent
+// lookups for the same uncached user are coalesced into a single lookup.
+type CachedRoles struct {
+	Roles       RoleLookup    // The lookup being cached
+	TTL         time.Duration // How long roles are cached
+	NegativeTTL time.Duration // How long failures are cached, not at all if zero
+	MaxSize     int           // Maximum number of cached users, unlimited if zero
+
+	// ServeStale returns expired roles if the lookup fails, rather than the
+	// failure.  The stale roles are then cached for NegativeTTL.
+	ServeStale bool
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // Most recently used at front
+	pending map[string]*pendingLookup
+}
+
+type cacheEntry struct {
+	key     string
+	roles   []Role
+	err     error
+	expires time.Time
+}
+
+type pendingLookup struct {
+	done  sync.WaitGroup
+	roles []Role
+	err   error
+}
+
+// Lookup returns cached roles for the user, looking them up if necessary
+func (c *CachedRoles) Lookup(u *User) ([]Role, error) {
+	if u == nil {
+		return c.Roles.Lookup(u)
+	}
+
+	key := u.ID
+
+	c.mutex.Lock()
+	if c.entries == nil {
+		c.entries = map[string]*list.Element{}
+		c.lru = list.New()
+		c.pending = map[string]*pendingLookup{}
+	}
+
+	entry := c.get(key)
+	if entry != nil && time.Now().Before(entry.expires) {
+		c.mutex.Unlock()
+		return copyRoles(entry.roles), entry.err
+	}
+
+	if p, ok := c.pending[key]; ok {
+		c.mutex.Unlock()
+		p.done.Wait()
+		return copyRoles(p.roles), p.err
+	}
+
+	p := &pendingLookup{}
+	p.done.Add(1)
+	c.pending[key] = p
+	c.mutex.Unlock()
+
+	p.roles, p.err = c.lookup(u)
+
+	c.mutex.Lock()
+	delete(c.pending, key)
+	p.roles, p.err = c.store(key, entry, p.roles, p.err)
+	c.mutex.Unlock()
+
+	p.done.Done()
+
+	return copyRoles(p.roles), p.err
+}
+
+// lookup looks up the user's roles, turning a panic into an error, so that
+// coalesced lookups waiting for it are always released
+func (c *CachedRoles) lookup(u *User) (roles []Role, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("role lookup panicked: %v", r)
+		}
+	}()
+
+	return c.Roles.Lookup(u)
+}
+
+// get finds the cache entry for the key, if any, and marks it as recently used.
+func (c *CachedRoles) get(key string) *cacheEntry {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry)
+}
+
+// store caches the result of a lookup, and determines what should be returned.
+// previous is the expired entry the lookup replaces, if any.
+func (c *CachedRoles) store(key string, previous *cacheEntry, roles []Role, err error) ([]Role, error) {
+	now := time.Now()
+
+	if err != nil {
+		if c.ServeStale && previous != nil && previous.err == nil {
+			log.Printf("Serving stale roles for %s: %v", key, err)
+			c.put(&cacheEntry{key: key, roles: previous.roles, expires: now.Add(c.NegativeTTL)})
+			return previous.roles, nil
+		}
+
+		if c.NegativeTTL > 0 {
+			c.put(&cacheEntry{key: key, err: err, expires: now.Add(c.NegativeTTL)})
+		}
+		return nil, err
+	}
+
+	c.put(&cacheEntry{key: key, roles: roles, expires: now.Add(c.TTL)})
+	return roles, nil
+}
+
+func (c *CachedRoles) put(entry *cacheEntry) {
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	for c.MaxSize > 0 && c.lru.Len() > c.MaxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func copyRoles(roles []Role) []Role {
+	if roles == nil {
+		return nil
+	}
+
+	return append([]Role(nil), roles...)
+}
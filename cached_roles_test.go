@@ -0,0 +1,248 @@
+package main_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+// CountingRoleLookup counts lookups, and returns the role or error it currently holds
+type CountingRoleLookup struct {
+	calls   int32
+	mutex   sync.Mutex
+	role    string
+	err     error
+	release chan struct{} // If not nil, lookups wait for it to be closed
+}
+
+func (l *CountingRoleLookup) Lookup(u *jhuda.User) ([]jhuda.Role, error) {
+	atomic.AddInt32(&l.calls, 1)
+
+	if l.release != nil {
+		<-l.release
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.err != nil {
+		return nil, l.err
+	}
+	return []jhuda.Role{{Name: l.role}}, nil
+}
+
+func (l *CountingRoleLookup) set(role string, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.role, l.err = role, err
+}
+
+func (l *CountingRoleLookup) Calls() int {
+	return int(atomic.LoadInt32(&l.calls))
+}
+
+func lookupRole(t *testing.T, lookup jhuda.RoleLookup, id string) (string, error) {
+	roles, err := lookup.Lookup(&jhuda.User{ID: id})
+	if err != nil {
+		return "", err
+	}
+	if len(roles) != 1 {
+		t.Fatalf("Expected one role, got %v", roles)
+	}
+	return roles[0].Name, nil
+}
+
+func TestCachedRolesTTL(t *testing.T) {
+	backend := &CountingRoleLookup{role: "admin"}
+	cache := &jhuda.CachedRoles{
+		Roles: backend,
+		TTL:   50 * time.Millisecond,
+	}
+
+	for i := 0; i < 3; i++ {
+		if role, _ := lookupRole(t, cache, "foo"); role != "admin" {
+			t.Fatalf("Got wrong role %s", role)
+		}
+	}
+	if backend.Calls() != 1 {
+		t.Fatalf("Expected a single lookup, got %d", backend.Calls())
+	}
+
+	backend.set("submitter", nil)
+	_, _ = lookupRole(t, cache, "bar")
+	if backend.Calls() != 2 {
+		t.Fatalf("Different users should be looked up separately")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if role, _ := lookupRole(t, cache, "foo"); role != "submitter" {
+		t.Fatalf("Expired roles should have been looked up again, got %s", role)
+	}
+}
+
+func TestCachedRolesLRU(t *testing.T) {
+	backend := &CountingRoleLookup{role: "admin"}
+	cache := &jhuda.CachedRoles{
+		Roles:   backend,
+		TTL:     time.Minute,
+		MaxSize: 2,
+	}
+
+	_, _ = lookupRole(t, cache, "a")
+	_, _ = lookupRole(t, cache, "b")
+	_, _ = lookupRole(t, cache, "a") // b is now least recently used
+	_, _ = lookupRole(t, cache, "c") // evicts b
+
+	calls := backend.Calls()
+	_, _ = lookupRole(t, cache, "a")
+	_, _ = lookupRole(t, cache, "c")
+	if backend.Calls() != calls {
+		t.Fatalf("Recently used users should still be cached")
+	}
+
+	_, _ = lookupRole(t, cache, "b")
+	if backend.Calls() != calls+1 {
+		t.Fatalf("Least recently used user should have been evicted")
+	}
+}
+
+func TestCachedRolesNegative(t *testing.T) {
+	backend := &CountingRoleLookup{err: errors.New("failed")}
+	cache := &jhuda.CachedRoles{
+		Roles:       backend,
+		TTL:         time.Minute,
+		NegativeTTL: 50 * time.Millisecond,
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := lookupRole(t, cache, "foo"); err == nil {
+			t.Fatalf("Expected error!")
+		}
+	}
+	if backend.Calls() != 1 {
+		t.Fatalf("Failure should have been cached, got %d lookups", backend.Calls())
+	}
+
+	backend.set("admin", nil)
+	time.Sleep(60 * time.Millisecond)
+	if role, err := lookupRole(t, cache, "foo"); err != nil || role != "admin" {
+		t.Fatalf("Expected to recover after negative TTL: %s %v", role, err)
+	}
+
+	uncached := &jhuda.CachedRoles{
+		Roles: backend,
+		TTL:   time.Minute,
+	}
+	backend.set("", errors.New("failed"))
+	calls := backend.Calls()
+	_, _ = lookupRole(t, uncached, "foo")
+	_, _ = lookupRole(t, uncached, "foo")
+	if backend.Calls() != calls+2 {
+		t.Fatalf("Failures should not be cached without a negative TTL")
+	}
+}
+
+func TestCachedRolesServeStale(t *testing.T) {
+	backend := &CountingRoleLookup{role: "admin"}
+	cache := &jhuda.CachedRoles{
+		Roles:       backend,
+		TTL:         10 * time.Millisecond,
+		NegativeTTL: time.Minute,
+		ServeStale:  true,
+	}
+
+	_, _ = lookupRole(t, cache, "foo")
+	backend.set("", errors.New("failed"))
+	time.Sleep(20 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		role, err := lookupRole(t, cache, "foo")
+		if err != nil || role != "admin" {
+			t.Fatalf("Expected stale role, got %s %v", role, err)
+		}
+	}
+	if backend.Calls() != 2 {
+		t.Fatalf("Stale roles should have been cached after the failure, got %d lookups", backend.Calls())
+	}
+
+	if _, err := lookupRole(t, cache, "bar"); err == nil {
+		t.Fatalf("Expected error with nothing stale to serve")
+	}
+}
+
+func TestCachedRolesCoalesced(t *testing.T) {
+	backend := &CountingRoleLookup{role: "admin", release: make(chan struct{})}
+	cache := &jhuda.CachedRoles{
+		Roles: backend,
+		TTL:   time.Minute,
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]jhuda.Role, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = cache.Lookup(&jhuda.User{ID: "foo"})
+		}(i)
+	}
+
+	// Give every lookup a chance to start before letting the backend answer
+	time.Sleep(50 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+
+	if backend.Calls() != 1 {
+		t.Fatalf("Concurrent lookups should have been coalesced, got %d", backend.Calls())
+	}
+
+	for _, roles := range results {
+		if diffs := deep.Equal(roles, []jhuda.Role{{Name: "admin"}}); len(diffs) > 0 {
+			t.Fatalf("Got wrong roles: %v", roles)
+		}
+	}
+}
+
+// PanickingRoleLookup panics on its first lookup, then finds the admin role
+type PanickingRoleLookup struct {
+	calls int32
+}
+
+func (p *PanickingRoleLookup) Lookup(u *jhuda.User) ([]jhuda.Role, error) {
+	if atomic.AddInt32(&p.calls, 1) == 1 {
+		panic("boom")
+	}
+	return []jhuda.Role{{Name: "admin"}}, nil
+}
+
+func TestCachedRolesPanic(t *testing.T) {
+	cache := &jhuda.CachedRoles{
+		Roles: &PanickingRoleLookup{},
+		TTL:   time.Minute,
+	}
+
+	if _, err := cache.Lookup(&jhuda.User{ID: "foo"}); err == nil {
+		t.Fatalf("Expected the panic as an error")
+	}
+
+	// A later lookup must not wait forever for the one that panicked
+	done := make(chan []jhuda.Role)
+	go func() {
+		roles, _ := cache.Lookup(&jhuda.User{ID: "foo"})
+		done <- roles
+	}()
+
+	select {
+	case roles := <-done:
+		if diffs := deep.Equal(roles, []jhuda.Role{{Name: "admin"}}); len(diffs) > 0 {
+			t.Fatalf("Got wrong roles: %v", roles)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Lookup after a panic never finished")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// RoleErrorPolicy determines what happens when a role source fails
+type RoleErrorPolicy int
+
+const (
+	// FailOnError fails the entire lookup if the source fails
+	FailOnError RoleErrorPolicy = iota
+
+	// SkipOnError logs the failure and continues without the source's roles
+	SkipOnError
+)
+
+// RoleSource is a named role lookup participating in a CompositeRoleLookup
+type RoleSource struct {
+	Name    string          // Name of the source, used in errors and logs
+	Roles   RoleLookup      // Lookup providing the roles
+	OnError RoleErrorPolicy // What to do when the lookup fails
+
+	// Upstream marks sources that call another service (e.g. LDAP), whose
+	// failures are upstream failures rather than errors of the user service
+	Upstream bool
+}
+
+// CompositeRoleLookup queries several role sources in order, and merges their
+// roles without duplicates.
+type CompositeRoleLookup struct {
+	Sources []RoleSource
+}
+
+// Lookup finds the roles from every source, according to each source's error policy
+func (c CompositeRoleLookup) Lookup(u *User) ([]Role, error) {
+	var roles []Role
+	seen := map[string]bool{}
+
+	for _, source := range c.Sources {
+		found, err := source.Roles.Lookup(u)
+		if err != nil {
+			if source.OnError == SkipOnError {
+				log.Printf("Skipping role source %s: %v", source.Name, err)
+				continue
+			}
+			if source.Upstream {
+				err = ErrorUpstream(err.Error())
+			}
+			return nil, errors.Wrapf(err, "role source %s failed", source.Name)
+		}
+
+		roles = append(roles, dedupeRoles(seen, found)...)
+	}
+
+	return roles, nil
+}
@@ -0,0 +1,74 @@
+package main_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestCompositeRoleLookup(t *testing.T) {
+	defaults := jhuda.RoleSource{
+		Name:  "defaults",
+		Roles: jhuda.RoleService{DefaultRoles: []string{"reader", "submitter"}},
+	}
+	others := jhuda.RoleSource{
+		Name:  "others",
+		Roles: FakeRoleLookup{roles: []jhuda.Role{{Name: "admin"}, {Name: "reader"}}},
+	}
+	broken := jhuda.RoleSource{
+		Name:  "broken",
+		Roles: FakeRoleLookup{err: errors.New("An error")},
+	}
+
+	skipped := broken
+	skipped.OnError = jhuda.SkipOnError
+
+	cases := map[string]struct {
+		sources     []jhuda.RoleSource
+		expected    []jhuda.Role
+		expectedErr bool
+	}{
+		"merged": {
+			sources:  []jhuda.RoleSource{defaults, others},
+			expected: []jhuda.Role{{Name: "reader"}, {Name: "submitter"}, {Name: "admin"}},
+		},
+		"skip on error": {
+			sources:  []jhuda.RoleSource{defaults, skipped, others},
+			expected: []jhuda.Role{{Name: "reader"}, {Name: "submitter"}, {Name: "admin"}},
+		},
+		"fail on error": {
+			sources:     []jhuda.RoleSource{defaults, broken, others},
+			expectedErr: true,
+		},
+		"no sources": {},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			roles, err := jhuda.CompositeRoleLookup{Sources: tc.sources}.Lookup(nil)
+
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatalf("Expected error, but got none")
+				}
+				if !strings.Contains(err.Error(), "broken") {
+					t.Fatalf("Error should name the failed source: %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+
+			diffs := deep.Equal(tc.expected, roles)
+			if len(diffs) > 0 {
+				t.Fatalf("Did not get expected roles:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
@@ -7,3 +7,35 @@ type ErrorBadInput string
 func (e ErrorBadInput) Error() string {
 	return string(e)
 }
+
+// ErrorMissingIdentity is returned when a request carries no identity at all,
+// e.g. it has no eppn
+type ErrorMissingIdentity string
+
+func (e ErrorMissingIdentity) Error() string {
+	return string(e)
+}
+
+// ErrorForbiddenDomain is returned when an identity is from a domain (scope)
+// that is not allowed
+type ErrorForbiddenDomain string
+
+func (e ErrorForbiddenDomain) Error() string {
+	return string(e)
+}
+
+// ErrorUpstream is returned when a service the user service depends on, such
+// as a role source, fails
+type ErrorUpstream string
+
+func (e ErrorUpstream) Error() string {
+	return string(e)
+}
+
+// ErrorForbiddenIdP is returned when an identity is from an identity provider
+// that is not allowed
+type ErrorForbiddenIdP string
+
+func (e ErrorForbiddenIdP) Error() string {
+	return string(e)
+}
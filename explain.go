@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+func explain() *cli.Command {
+
+	var us UserService
+	var ic idConfig
+	var rulesFile string
+
+	return &cli.Command{
+		Name:      "explain",
+		Usage:     "Show which role rules fire for a sample set of headers",
+		ArgsUsage: "[header: value]...",
+		Flags: append(userFlags(&us, &ic),
+			&cli.StringFlag{
+				Name:        "roleRulesFile",
+				Usage:       "JSON file with rules granting roles based on user attributes",
+				Required:    true,
+				Destination: &rulesFile,
+				EnvVars:     []string{"USER_SERVICE_ROLE_RULES_FILE"},
+			},
+		),
+		Action: func(c *cli.Context) error {
+			if err := applyUserFlags(c, &us, ic); err != nil {
+				return err
+			}
+
+			rules, err := LoadRoleRules(rulesFile)
+			if err != nil {
+				return err
+			}
+
+			headers, err := parseHeaderArgs(c.Args().Slice())
+			if err != nil {
+				return err
+			}
+
+			return explainRules(c.App.Writer, us, rules, headers)
+		},
+	}
+}
+
+// parseHeaderArgs parses arguments of the form 'header: value'
+func parseHeaderArgs(args []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, ":", 2)
+		if len(parts) != 2 {
+			return nil, ErrorBadInput(fmt.Sprintf("Expected 'header: value', instead got '%s'", arg))
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	return headers, nil
+}
+
+// explainRules writes the user resolved from the given headers, and which of
+// the rules fired for them
+func explainRules(w io.Writer, us UserService, rules *RoleRules, headers HeaderProvider) error {
+	user, err := us.FromHeaders(headers)
+	if err != nil {
+		return err
+	}
+
+	if err := user.Serialize(w); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	env := userEnv(user)
+	for _, rule := range rules.Rules {
+		fired, err := rule.fires(env)
+		if err != nil {
+			return err
+		}
+
+		mark := " "
+		if fired {
+			mark = "x"
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n    when %s\n", mark, rule.Name, strings.Join(rule.Roles, ", "), rule.When)
+	}
+
+	roles, err := rules.Lookup(user)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, role := range dedupeRoles(map[string]bool{}, roles) {
+		names = append(names, role.Simple())
+	}
+	fmt.Fprintf(w, "\nRoles: %s\n", strings.Join(names, ", "))
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestExplainRules(t *testing.T) {
+	rules, err := LoadRoleRules("testdata/role-rules.json")
+	if err != nil {
+		t.Fatalf("Could not load role rules: %v", err)
+	}
+
+	headers := http.Header{}
+	headers.Add("Eppn", "admin@example.org")
+	headers.Add("Employeenumber", "123")
+
+	var out bytes.Buffer
+	err = explainRules(&out, UserService{}, rules, headers)
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+
+	for _, expected := range []string{
+		`"@id": "admin@example.org"`,
+		"[ ] JHMI staff: submitter",
+		"[x] Employees: submitter, reviewer",
+		"[x] Admins: admin",
+		"Roles: submitter, reviewer, admin",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Output does not contain '%s':\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestExplainBadHeaders(t *testing.T) {
+	rules, _ := LoadRoleRules("testdata/role-rules.json")
+
+	err := explainRules(&bytes.Buffer{}, UserService{}, rules, http.Header{})
+	if err == nil {
+		t.Fatalf("Expected error for missing eppn")
+	}
+}
+
+func TestExplainUserFlags(t *testing.T) {
+	var out bytes.Buffer
+	app := &cli.App{
+		Writer:   &out,
+		Commands: []*cli.Command{explain()},
+	}
+
+	err := app.Run([]string{"user-service", "explain",
+		"-roleRulesFile", "testdata/role-rules.json",
+		"-stripAffiliationScope",
+		"-allowedAffiliations", "staff",
+		"-idScheme", "escaped",
+		"Eppn: bo@jhmi.edu", "Mail: bo@jhmi.edu", "Affiliation: staff@jhmi.edu;student@jhmi.edu",
+	})
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+
+	for _, expected := range []string{
+		`"affiliation": [`,
+		"[x] JHMI staff: submitter",
+		"Roles: submitter",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Output does not contain '%s':\n%s", expected, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "student") {
+		t.Errorf("Affiliations were not filtered:\n%s", out.String())
+	}
+}
@@ -0,0 +1,718 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// expr is a compiled boolean expression over user attributes.  The syntax is a
+// small subset of CEL (https://github.com/google/cel-spec):
+//
+//	email.endsWith("@jhmi.edu") && "staff" in affiliation
+//	!(eppn in ["a@jhu.edu", "b@jhu.edu"]) || firstName == "Bo"
+//	locatorIds.exists(l, l.startsWith("johnshopkins.edu:Employeenumber:"))
+//	email.matches("^[a-z]+@jhu\\.edu$")
+//
+// Values are strings, booleans, or lists of strings.  Strings support ==, !=, in,
+// and the methods startsWith, endsWith, contains, and matches.  Lists support the
+// exists and all macros.
+type expr struct {
+	source string
+	root   exprNode
+}
+
+// exprEnv binds names to values during evaluation
+type exprEnv map[string]interface{}
+
+// exprType is the type of an expression's values
+type exprType int
+
+const (
+	typeString exprType = iota
+	typeBool
+	typeList
+)
+
+func (t exprType) String() string {
+	switch t {
+	case typeString:
+		return "string"
+	case typeBool:
+		return "boolean"
+	default:
+		return "list"
+	}
+}
+
+// exprTypes binds names to the types of their values, for checking
+type exprTypes map[string]exprType
+
+type exprNode interface {
+	eval(env exprEnv) (interface{}, error)
+
+	// check determines the node's type without evaluating it, so that every
+	// branch is checked, even those evaluation would skip
+	check(types exprTypes) (exprType, error)
+}
+
+// typesOf gives the types of the values bound by the environment
+func typesOf(env exprEnv) (exprTypes, error) {
+	types := exprTypes{}
+	for name, val := range env {
+		t, err := typeOf(val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "name '%s'", name)
+		}
+		types[name] = t
+	}
+
+	return types, nil
+}
+
+func typeOf(val interface{}) (exprType, error) {
+	switch val.(type) {
+	case string:
+		return typeString, nil
+	case bool:
+		return typeBool, nil
+	case []string:
+		return typeList, nil
+	default:
+		return 0, errors.Errorf("unsupported value %v", val)
+	}
+}
+
+// compileExpr parses an expression
+func compileExpr(source string) (*expr, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad expression '%s'", source)
+	}
+
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && !p.done() {
+		err = errors.Errorf("unexpected '%s'", p.peek().text)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad expression '%s'", source)
+	}
+
+	return &expr{source: source, root: root}, nil
+}
+
+// eval evaluates the expression, which must be boolean
+func (e *expr) eval(env exprEnv) (bool, error) {
+	val, err := e.root.eval(env)
+	if err != nil {
+		return false, errors.Wrapf(err, "could not evaluate '%s'", e.source)
+	}
+
+	b, ok := val.(bool)
+	if !ok {
+		return false, errors.Errorf("'%s' is not a boolean expression", e.source)
+	}
+
+	return b, nil
+}
+
+// check checks the names and types of the expression, which must be boolean
+func (e *expr) check(types exprTypes) error {
+	t, err := e.root.check(types)
+	if err != nil {
+		return errors.Wrapf(err, "bad expression '%s'", e.source)
+	}
+	if t != typeBool {
+		return errors.Errorf("'%s' is not a boolean expression", e.source)
+	}
+
+	return nil
+}
+
+// Tokens
+
+type tokenKind int
+
+const (
+	tokenIdent tokenKind = iota
+	tokenString
+	tokenSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	runes := []rune(source)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, string(runes[start:i])})
+		case r == '"' || r == '\'':
+			start := i
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(runes) {
+				return nil, errors.Errorf("unterminated string at %d", start)
+			}
+			i++
+
+			val, err := unquote(string(runes[start:i]))
+			if err != nil {
+				return nil, errors.Errorf("bad string %s", string(runes[start:i]))
+			}
+			tokens = append(tokens, token{tokenString, val})
+		default:
+			if i+1 < len(runes) {
+				two := string(runes[i : i+2])
+				if two == "&&" || two == "||" || two == "==" || two == "!=" {
+					tokens = append(tokens, token{tokenSymbol, two})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("()[],.!", r) {
+				return nil, errors.Errorf("unexpected character '%c' at %d", r, i)
+			}
+			tokens = append(tokens, token{tokenSymbol, string(r)})
+			i++
+		}
+	}
+
+	return tokens, nil
+}
+
+// unquote unescapes a single or double quoted string literal.  Either quote
+// may be escaped within either kind of string.
+func unquote(quoted string) (string, error) {
+	quote := quoted[0]
+	s := quoted[1 : len(quoted)-1]
+
+	var b strings.Builder
+	for len(s) > 0 {
+		if strings.HasPrefix(s, `\'`) || strings.HasPrefix(s, `\"`) {
+			b.WriteByte(s[1])
+			s = s[2:]
+			continue
+		}
+
+		r, multibyte, tail, err := strconv.UnquoteChar(s, quote)
+		if err != nil {
+			return "", err
+		}
+		if r < utf8.RuneSelf || !multibyte {
+			b.WriteByte(byte(r))
+		} else {
+			b.WriteRune(r)
+		}
+		s = tail
+	}
+
+	return b.String(), nil
+}
+
+// Parser
+
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *exprParser) peek() token {
+	if p.done() {
+		return token{kind: tokenSymbol, text: "end of expression"}
+	}
+	return p.tokens[p.pos]
+}
+
+// accept consumes the next token if it is the given symbol or keyword
+func (p *exprParser) accept(text string) bool {
+	if !p.done() && p.tokens[p.pos].kind != tokenString && p.tokens[p.pos].text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.accept(text) {
+		return errors.Errorf("expected '%s' but got '%s'", text, p.peek().text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||") {
+		var right exprNode
+		right, err = p.parseAnd()
+		left = orNode{left, right}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.accept("&&") {
+		var right exprNode
+		right, err = p.parseUnary()
+		left = andNode{left, right}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		return notNode{operand}, err
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseMember()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range []string{"==", "!=", "in"} {
+		if p.accept(op) {
+			right, err := p.parseMember()
+			return compareNode{op, left, right}, err
+		}
+	}
+
+	return left, nil
+}
+
+// parseMember parses a primary expression followed by any method calls
+func (p *exprParser) parseMember() (exprNode, error) {
+	node, err := p.parsePrimary()
+
+	for err == nil && p.accept(".") {
+		method := p.peek()
+		if method.kind != tokenIdent {
+			return nil, errors.Errorf("expected method name but got '%s'", method.text)
+		}
+		p.pos++
+
+		if err = p.expect("("); err != nil {
+			return nil, err
+		}
+
+		switch method.text {
+		case "exists", "all":
+			node, err = p.parseMacro(method.text, node)
+		case "startsWith", "endsWith", "contains", "matches":
+			node, err = p.parseMethod(method.text, node)
+		default:
+			return nil, errors.Errorf("unknown method '%s'", method.text)
+		}
+	}
+
+	return node, err
+}
+
+func (p *exprParser) parseMacro(name string, list exprNode) (exprNode, error) {
+	variable := p.peek()
+	if variable.kind != tokenIdent {
+		return nil, errors.Errorf("expected variable name but got '%s'", variable.text)
+	}
+	p.pos++
+
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+
+	predicate, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	return macroNode{name, list, variable.text, predicate}, p.expect(")")
+}
+
+func (p *exprParser) parseMethod(name string, receiver exprNode) (exprNode, error) {
+	arg, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	node := methodNode{name: name, receiver: receiver, arg: arg}
+
+	if name == "matches" {
+		literal, _ := arg.(literalNode)
+		pattern, ok := literal.val.(string)
+		if !ok {
+			return nil, errors.Errorf("matches requires a string literal")
+		}
+		if node.re, err = regexp.Compile(pattern); err != nil {
+			return nil, errors.Wrapf(err, "bad regex")
+		}
+	}
+
+	return node, p.expect(")")
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.peek()
+	if p.done() {
+		return nil, errors.Errorf("unexpected end of expression")
+	}
+	p.pos++
+
+	switch {
+	case tok.kind == tokenString:
+		return literalNode{tok.text}, nil
+	case tok.kind == tokenIdent && (tok.text == "true" || tok.text == "false"):
+		return literalNode{tok.text == "true"}, nil
+	case tok.kind == tokenIdent && tok.text != "in":
+		return identNode{tok.text}, nil
+	case tok.text == "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	case tok.text == "[":
+		var items []string
+		for !p.accept("]") {
+			if len(items) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			item := p.peek()
+			if item.kind != tokenString {
+				return nil, errors.Errorf("lists may only contain strings, got '%s'", item.text)
+			}
+			p.pos++
+			items = append(items, item.text)
+		}
+		return literalNode{items}, nil
+	}
+
+	return nil, errors.Errorf("unexpected '%s'", tok.text)
+}
+
+// Evaluation
+
+type literalNode struct {
+	val interface{}
+}
+
+func (n literalNode) eval(exprEnv) (interface{}, error) {
+	return n.val, nil
+}
+
+func (n literalNode) check(exprTypes) (exprType, error) {
+	return typeOf(n.val)
+}
+
+type identNode struct {
+	name string
+}
+
+func (n identNode) eval(env exprEnv) (interface{}, error) {
+	val, ok := env[n.name]
+	if !ok {
+		return nil, errors.Errorf("unknown name '%s'", n.name)
+	}
+	return val, nil
+}
+
+func (n identNode) check(types exprTypes) (exprType, error) {
+	t, ok := types[n.name]
+	if !ok {
+		return 0, errors.Errorf("unknown name '%s'", n.name)
+	}
+	return t, nil
+}
+
+type notNode struct {
+	operand exprNode
+}
+
+func (n notNode) eval(env exprEnv) (interface{}, error) {
+	b, err := evalBool(n.operand, env)
+	return !b, err
+}
+
+func (n notNode) check(types exprTypes) (exprType, error) {
+	return typeBool, checkType(n.operand, types, typeBool, "!")
+}
+
+type andNode struct {
+	left, right exprNode
+}
+
+func (n andNode) eval(env exprEnv) (interface{}, error) {
+	left, err := evalBool(n.left, env)
+	if err != nil || !left {
+		return false, err
+	}
+	return evalBool(n.right, env)
+}
+
+func (n andNode) check(types exprTypes) (exprType, error) {
+	if err := checkType(n.left, types, typeBool, "&&"); err != nil {
+		return 0, err
+	}
+	return typeBool, checkType(n.right, types, typeBool, "&&")
+}
+
+type orNode struct {
+	left, right exprNode
+}
+
+func (n orNode) eval(env exprEnv) (interface{}, error) {
+	left, err := evalBool(n.left, env)
+	if err != nil || left {
+		return left, err
+	}
+	return evalBool(n.right, env)
+}
+
+func (n orNode) check(types exprTypes) (exprType, error) {
+	if err := checkType(n.left, types, typeBool, "||"); err != nil {
+		return 0, err
+	}
+	return typeBool, checkType(n.right, types, typeBool, "||")
+}
+
+type compareNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n compareNode) eval(env exprEnv) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.op == "in" {
+		s, ok := left.(string)
+		list, isList := right.([]string)
+		if !ok || !isList {
+			return nil, errors.Errorf("'in' requires a string and a list")
+		}
+		for _, item := range list {
+			if item == s {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	equal, err := equalValues(left, right)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!=" {
+		return !equal, nil
+	}
+	return equal, nil
+}
+
+func (n compareNode) check(types exprTypes) (exprType, error) {
+	left, err := n.left.check(types)
+	if err != nil {
+		return 0, err
+	}
+	right, err := n.right.check(types)
+	if err != nil {
+		return 0, err
+	}
+
+	if n.op == "in" {
+		if left != typeString || right != typeList {
+			return 0, errors.Errorf("'in' requires a string and a list, not a %s and a %s", left, right)
+		}
+	} else if left != right {
+		return 0, errors.Errorf("cannot compare a %s and a %s", left, right)
+	}
+
+	return typeBool, nil
+}
+
+// equalValues compares values of the same type
+func equalValues(left, right interface{}) (bool, error) {
+	switch l := left.(type) {
+	case string:
+		if r, ok := right.(string); ok {
+			return l == r, nil
+		}
+	case bool:
+		if r, ok := right.(bool); ok {
+			return l == r, nil
+		}
+	case []string:
+		if r, ok := right.([]string); ok {
+			if len(l) != len(r) {
+				return false, nil
+			}
+			for i := range l {
+				if l[i] != r[i] {
+					return false, nil
+				}
+			}
+			return true, nil
+		}
+	}
+
+	return false, errors.Errorf("cannot compare %v and %v", left, right)
+}
+
+type methodNode struct {
+	name     string
+	receiver exprNode
+	arg      exprNode
+	re       *regexp.Regexp
+}
+
+func (n methodNode) eval(env exprEnv) (interface{}, error) {
+	receiver, err := n.receiver.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := receiver.(string)
+	if !ok {
+		return nil, errors.Errorf("%s requires a string", n.name)
+	}
+
+	if n.re != nil {
+		return n.re.MatchString(s), nil
+	}
+
+	arg, err := n.arg.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	a, ok := arg.(string)
+	if !ok {
+		return nil, errors.Errorf("%s requires a string argument", n.name)
+	}
+
+	switch n.name {
+	case "startsWith":
+		return strings.HasPrefix(s, a), nil
+	case "endsWith":
+		return strings.HasSuffix(s, a), nil
+	default:
+		return strings.Contains(s, a), nil
+	}
+}
+
+func (n methodNode) check(types exprTypes) (exprType, error) {
+	if err := checkType(n.receiver, types, typeString, n.name); err != nil {
+		return 0, err
+	}
+	return typeBool, checkType(n.arg, types, typeString, n.name+" argument")
+}
+
+type macroNode struct {
+	name      string
+	list      exprNode
+	variable  string
+	predicate exprNode
+}
+
+func (n macroNode) eval(env exprEnv) (interface{}, error) {
+	val, err := n.list.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := val.([]string)
+	if !ok {
+		return nil, errors.Errorf("%s requires a list", n.name)
+	}
+
+	scope := make(exprEnv, len(env)+1)
+	for k, v := range env {
+		scope[k] = v
+	}
+
+	for _, item := range list {
+		scope[n.variable] = item
+		b, err := evalBool(n.predicate, scope)
+		if err != nil {
+			return nil, err
+		}
+		if n.name == "exists" && b {
+			return true, nil
+		}
+		if n.name == "all" && !b {
+			return false, nil
+		}
+	}
+
+	return n.name == "all", nil
+}
+
+func (n macroNode) check(types exprTypes) (exprType, error) {
+	if err := checkType(n.list, types, typeList, n.name); err != nil {
+		return 0, err
+	}
+
+	scope := make(exprTypes, len(types)+1)
+	for k, v := range types {
+		scope[k] = v
+	}
+	scope[n.variable] = typeString
+
+	return typeBool, checkType(n.predicate, scope, typeBool, n.name+" predicate")
+}
+
+// checkType checks that the node is of the expected type
+func checkType(node exprNode, types exprTypes, expected exprType, what string) error {
+	t, err := node.check(types)
+	if err != nil {
+		return err
+	}
+	if t != expected {
+		return errors.Errorf("%s requires a %s, not a %s", what, expected, t)
+	}
+	return nil
+}
+
+func evalBool(node exprNode, env exprEnv) (bool, error) {
+	val, err := node.eval(env)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := val.(bool)
+	if !ok {
+		return false, errors.Errorf("expected a boolean, got %v", val)
+	}
+	return b, nil
+}
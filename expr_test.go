@@ -0,0 +1,161 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	env := exprEnv{
+		"email":       "bo@jhmi.edu",
+		"eppn":        "bo@jhu.edu",
+		"name":        "",
+		"affiliation": []string{"staff", "member"},
+		"locatorIds":  []string{"jhu.edu:Employeenumber:123", "jhu.edu:Eppn:bo@jhu.edu"},
+		"empty":       []string{},
+	}
+
+	cases := map[string]bool{
+		`email.endsWith("@jhmi.edu")`:                                  true,
+		`email.startsWith('bo@')`:                                      true,
+		`email.contains("jhmi") && eppn.contains("jhmi")`:              false,
+		`email.contains("jhmi") || eppn.contains("jhmi")`:              true,
+		`"staff" in affiliation`:                                       true,
+		`"faculty" in affiliation`:                                     false,
+		`!("faculty" in affiliation)`:                                  true,
+		`eppn in ["bo@jhu.edu", "al@jhu.edu"]`:                         true,
+		`eppn == "bo@jhu.edu" && name != "Bo"`:                         true,
+		`name == ""`:                                                   true,
+		`email.matches("^[a-z]+@jhmi\\.edu$")`:                         true,
+		`email.matches("^[0-9]+@")`:                                    false,
+		`locatorIds.exists(l, l.startsWith("jhu.edu:Employeenumber"))`: true,
+		`locatorIds.all(l, l.startsWith("jhu.edu:"))`:                  true,
+		`affiliation.all(a, a == "staff")`:                             false,
+		`empty.exists(e, true)`:                                        false,
+		`empty.all(e, false)`:                                          true,
+		`true && !false`:                                               true,
+		`(true || false) && false`:                                     false,
+		`'it\'s' == "it's"`:                                            true,
+		`affiliation == ["staff", "member"]`:                           true,
+		`affiliation == ["staff member"]`:                              false,
+		`affiliation == ["member", "staff"]`:                           false,
+		`affiliation != ["staff"]`:                                     true,
+		`empty == []`:                                                  true,
+		`'a\"b' == "a\"b"`:                                             true,
+		`'a"b' == "a\"b"`:                                              true,
+		`'tab\there' == "tab\there"`:                                   true,
+	}
+
+	for source, expected := range cases {
+		source, expected := source, expected
+		t.Run(source, func(t *testing.T) {
+			e, err := compileExpr(source)
+			if err != nil {
+				t.Fatalf("Could not compile: %v", err)
+			}
+
+			result, err := e.eval(env)
+			if err != nil {
+				t.Fatalf("Could not evaluate: %v", err)
+			}
+
+			if result != expected {
+				t.Fatalf("Expected %t, got %t", expected, result)
+			}
+		})
+	}
+}
+
+func TestBadExpr(t *testing.T) {
+	cases := []string{
+		``,
+		`email ==`,
+		`email.endsWith("foo"`,
+		`"unterminated`,
+		`'bad \q escape'`,
+		`email.lowerAscii()`,
+		`email.matches(pattern)`,
+		`email.matches("(")`,
+		`["a", b]`,
+		`email == "a" "b"`,
+		`email = "a"`,
+		`list.exists("a", true)`,
+	}
+
+	for _, source := range cases {
+		source := source
+		t.Run(source, func(t *testing.T) {
+			if _, err := compileExpr(source); err == nil {
+				t.Fatalf("Expected error!")
+			}
+		})
+	}
+}
+
+func TestExprCheck(t *testing.T) {
+	types := exprTypes{
+		"email":       typeString,
+		"affiliation": typeList,
+	}
+
+	cases := map[string]bool{
+		`email == "a" && "staff" in affiliation`:      true,
+		`affiliation.exists(a, a.startsWith(email))`:  true,
+		`false && unknown == "a"`:                     false,
+		`true || email.endsWith(affiliation)`:         false,
+		`affiliation.exists(a, a == email) || !email`: false,
+		`affiliation.all(a, a in affiliation) && "a"`: false,
+		`affiliation == ["a"] || affiliation == "a"`:  false,
+		`email`: false,
+		`affiliation.exists(a, a) && email == "a"`: false,
+	}
+
+	for source, valid := range cases {
+		source, valid := source, valid
+		t.Run(source, func(t *testing.T) {
+			e, err := compileExpr(source)
+			if err != nil {
+				t.Fatalf("Could not compile: %v", err)
+			}
+
+			err = e.check(types)
+			if valid && err != nil {
+				t.Fatalf("Expected expression to be valid: %v", err)
+			}
+			if !valid && err == nil {
+				t.Fatalf("Expected expression to be invalid")
+			}
+		})
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	env := exprEnv{
+		"email":       "bo@jhmi.edu",
+		"affiliation": []string{"staff"},
+	}
+
+	cases := []string{
+		`unknown == "a"`,
+		`email`,
+		`email == affiliation`,
+		`affiliation in email`,
+		`affiliation.endsWith("a")`,
+		`email.exists(e, true)`,
+		`affiliation.exists(a, a)`,
+		`!email`,
+	}
+
+	for _, source := range cases {
+		source := source
+		t.Run(source, func(t *testing.T) {
+			e, err := compileExpr(source)
+			if err != nil {
+				t.Fatalf("Could not compile: %v", err)
+			}
+
+			if _, err := e.eval(env); err == nil {
+				t.Fatalf("Expected error!")
+			}
+		})
+	}
+}
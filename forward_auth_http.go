@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Identity headers set on successful forward auth responses, for the proxy to
+// pass along to upstream applications
+const (
+	UserIDHeader    = "X-User-Id"
+	UserRolesHeader = "X-User-Roles"
+	UserEmailHeader = "X-User-Email"
+)
+
+// Headers giving the original request to forward auth, by default.  Traefik
+// sets these; nginx must be configured to set them, or ForwardedRequest
+// changed to the headers it sets.
+const (
+	DefaultForwardedMethodHeader = "X-Forwarded-Method"
+	DefaultForwardedURIHeader    = "X-Forwarded-Uri"
+)
+
+// ForwardedRequest names the headers in which the proxy gives the method and URI
+// of the original request to forward auth.  The proxy must overwrite them, as
+// any a client sends would otherwise decide which rule applies.
+type ForwardedRequest struct {
+	MethodHeader string // DefaultForwardedMethodHeader if empty
+	URIHeader    string // DefaultForwardedURIHeader if empty
+}
+
+// httpForwardAuthService is a forward auth backend for nginx auth_request or
+// Traefik ForwardAuth.  The original request is given by the headers named by
+// forwarded, and is checked against the path rules.  If rules is nil, any
+// identified user is allowed.
+//
+// Responds 200 with identity headers if allowed, 401 if the path requires an
+// identity and there is none, or 403 if the user lacks a required role, is from
+// a forbidden domain, no rule matches, or the path is ambiguous.  Errors are
+// problem+json.
+func httpForwardAuthService(svc userProvider, rules *PathRules, forwarded ForwardedRequest) http.Handler {
+	return checkAccess(svc, rules, forwarded.describe)
+}
+
+// httpExtAuthzService is an Envoy HTTP ext_authz server.  Envoy sends the
+// original method and path (after any configured path_prefix, which must be
+// stripped before reaching this handler), and the request is checked against the
+// path rules as for forward auth.  Identity headers in the response can be added
+// to the upstream request with allowed_upstream_headers.
+func httpExtAuthzService(svc userProvider, rules *PathRules) http.Handler {
+	return checkAccess(svc, rules, func(r *http.Request) (string, string, error) {
+		path, err := requestPath(r.URL)
+		return r.Method, path, err
+	})
+}
+
+// checkAccess checks the request described by the given function against the
+// path rules, responding with identity headers if allowed
+func checkAccess(svc userProvider, rules *PathRules, describe func(*http.Request) (string, string, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, err := describe(r)
+		if err != nil {
+			writeProblem(w, Problem{
+				Type:   ProblemAmbiguousPath,
+				Title:  "Ambiguous path",
+				Status: http.StatusForbidden,
+				Detail: err.Error(),
+			})
+			return
+		}
+
+		rule := &PathRule{}
+		if rules != nil {
+			rule = rules.Match(method, path)
+		}
+		if rule == nil {
+			writeProblem(w, Problem{
+				Type:   ProblemNoAccessRule,
+				Title:  "No access rule",
+				Status: http.StatusForbidden,
+				Detail: "No access rule for " + method + " " + path,
+			})
+			return
+		}
+
+		user, err := svc.FromHeaders(r.Header)
+		if err != nil {
+			if rule.Anonymous && identityError(err) {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			writeProblem(w, authProblem(err))
+			return
+		}
+
+		if missing := missingRoles(user, rule.Roles); len(missing) > 0 {
+			writeProblem(w, missingRolesProblem(user, missing))
+			return
+		}
+
+		w.Header().Set(UserIDHeader, user.ID)
+		w.Header().Set(UserRolesHeader, strings.Join(user.Roles, ","))
+		if user.Email != "" {
+			w.Header().Set(UserEmailHeader, user.Email)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// describe finds the method and path of the request being authorized
+func (f ForwardedRequest) describe(r *http.Request) (string, string, error) {
+	method := r.Header.Get(oneOf(f.MethodHeader, DefaultForwardedMethodHeader))
+	method = oneOf(method, r.Method)
+
+	uri := r.Header.Get(oneOf(f.URIHeader, DefaultForwardedURIHeader))
+	u, err := url.ParseRequestURI(oneOf(uri, "/"))
+	if err != nil {
+		return "", "", errors.Errorf("malformed request URI '%s'", uri)
+	}
+
+	path, err := requestPath(u)
+	return method, path, err
+}
+
+// requestPath gives the decoded path of the URL.  Paths with encoded slashes or
+// encoded dot segments are refused, since backends may decode them differently
+// than they are matched against path rules.
+func requestPath(u *url.URL) (string, error) {
+	escaped := u.EscapedPath()
+	for _, segment := range strings.Split(escaped, "/") {
+		lower := strings.ToLower(segment)
+		if strings.Contains(lower, "%2f") || strings.Contains(lower, "%5c") {
+			return "", errors.Errorf("encoded slash in path '%s'", escaped)
+		}
+		if decoded, err := url.PathUnescape(segment); err == nil && decoded != segment && (decoded == "." || decoded == "..") {
+			return "", errors.Errorf("encoded dot segment in path '%s'", escaped)
+		}
+	}
+
+	return u.Path, nil
+}
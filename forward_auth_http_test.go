@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardAuth(t *testing.T) {
+	rules, err := LoadPathRules("testdata/path-rules.json")
+	if err != nil {
+		t.Fatalf("Could not load path rules: %v", err)
+	}
+
+	submitter := &User{
+		ID:    "foo@example.org",
+		Email: "foo@example.org",
+		Roles: []string{"submitter", "reader"},
+	}
+
+	cases := map[string]struct {
+		headers      map[string]string
+		forwarded    ForwardedRequest
+		rules        *PathRules
+		err          error
+		expectedCode int
+	}{
+		"allowed": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/submissions/1?foo=bar", "X-Forwarded-Method": "POST"},
+			expectedCode: http.StatusOK,
+		},
+		"nginx headers": {
+			headers:      map[string]string{"X-Original-URI": "/submissions/1", "X-Original-Method": "PUT"},
+			forwarded:    ForwardedRequest{MethodHeader: "X-Original-Method", URIHeader: "X-Original-URI"},
+			expectedCode: http.StatusOK,
+		},
+		"spoofed forwarded uri": {
+			headers:      map[string]string{"X-Original-URI": "/admin/x", "X-Forwarded-Uri": "/public"},
+			forwarded:    ForwardedRequest{MethodHeader: "X-Original-Method", URIHeader: "X-Original-URI"},
+			err:          ErrorMissingIdentity("No eppn"),
+			expectedCode: http.StatusUnauthorized,
+		},
+		"spoofed original uri": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/admin/x", "X-Original-URI": "/public"},
+			err:          ErrorMissingIdentity("No eppn"),
+			expectedCode: http.StatusUnauthorized,
+		},
+		"lacks role": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/admin/users", "X-Forwarded-Method": "GET"},
+			expectedCode: http.StatusForbidden,
+		},
+		"path traversal": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/public/../admin/users"},
+			expectedCode: http.StatusForbidden,
+		},
+		"encoded slash traversal": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/admin/x%2F..%2F..%2Fpublic"},
+			err:          ErrorMissingIdentity("No eppn"),
+			expectedCode: http.StatusForbidden,
+		},
+		"encoded backslash": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/public/..%5cadmin"},
+			err:          ErrorMissingIdentity("No eppn"),
+			expectedCode: http.StatusForbidden,
+		},
+		"encoded dot segment": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/public/%2e%2E/admin"},
+			err:          ErrorMissingIdentity("No eppn"),
+			expectedCode: http.StatusForbidden,
+		},
+		"encoded letters": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/%61dmin/users"},
+			expectedCode: http.StatusForbidden,
+		},
+		"malformed uri": {
+			headers:      map[string]string{"X-Forwarded-Uri": "public"},
+			err:          ErrorMissingIdentity("No eppn"),
+			expectedCode: http.StatusForbidden,
+		},
+		"no identity": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/foo"},
+			err:          ErrorBadInput("No eppn"),
+			expectedCode: http.StatusUnauthorized,
+		},
+		"anonymous": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/public/index.html"},
+			err:          ErrorBadInput("No eppn"),
+			expectedCode: http.StatusOK,
+		},
+		"anonymous without eppn": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/public/index.html"},
+			err:          ErrorMissingIdentity("No eppn"),
+			expectedCode: http.StatusOK,
+		},
+		"forbidden domain": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/foo"},
+			err:          ErrorForbiddenDomain("Not here"),
+			expectedCode: http.StatusForbidden,
+		},
+		"upstream failure on anonymous path": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/public/index.html"},
+			err:          ErrorUpstream("LDAP is down"),
+			expectedCode: http.StatusBadGateway,
+		},
+		"internal error": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/foo"},
+			err:          errors.New("Boooo"),
+			expectedCode: http.StatusInternalServerError,
+		},
+		"no matching rule": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/foo"},
+			rules:        &PathRules{Rules: []PathRule{{Prefix: "/admin"}}},
+			expectedCode: http.StatusForbidden,
+		},
+		"no rules": {
+			headers:      map[string]string{"X-Forwarded-Uri": "/admin"},
+			rules:        &PathRules{},
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/forwardauth", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			pathRules := rules
+			if tc.rules != nil {
+				pathRules = tc.rules
+			}
+
+			resp := httptest.NewRecorder()
+			httpForwardAuthService(FakeUserProvider(func() (*User, error) {
+				if tc.err != nil {
+					return nil, tc.err
+				}
+				return submitter, nil
+			}), pathRules, tc.forwarded).ServeHTTP(resp, req)
+
+			if resp.Code != tc.expectedCode {
+				t.Fatalf("Got code %d, but expected %d: %s", resp.Code, tc.expectedCode, resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestForwardAuthIdentityHeaders(t *testing.T) {
+	user := &User{
+		ID:    "http://example.org/users/foo@example.org",
+		Email: "foo@example.org",
+		Roles: []string{"submitter", "reader"},
+	}
+
+	resp := httptest.NewRecorder()
+	httpForwardAuthService(FakeUserProvider(func() (*User, error) {
+		return user, nil
+	}), nil, ForwardedRequest{}).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/forwardauth", nil))
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Got code %d, but expected %d", resp.Code, http.StatusOK)
+	}
+
+	expected := map[string]string{
+		UserIDHeader:    user.ID,
+		UserRolesHeader: "submitter,reader",
+		UserEmailHeader: user.Email,
+	}
+	for header, val := range expected {
+		if resp.Header().Get(header) != val {
+			t.Errorf("Expected header %s to be '%s', got '%s'", header, val, resp.Header().Get(header))
+		}
+	}
+}
+
+func TestExtAuthz(t *testing.T) {
+	rules, err := LoadPathRules("testdata/path-rules.json")
+	if err != nil {
+		t.Fatalf("Could not load path rules: %v", err)
+	}
+
+	user := &User{
+		ID:    "foo@example.org",
+		Roles: []string{"submitter"},
+	}
+
+	cases := map[string]struct {
+		method       string
+		path         string
+		expectedCode int
+	}{
+		"allowed": {
+			method:       http.MethodPost,
+			path:         "/extauthz/submissions/1",
+			expectedCode: http.StatusOK,
+		},
+		"lacks role": {
+			method:       http.MethodGet,
+			path:         "/extauthz/admin?foo=bar",
+			expectedCode: http.StatusForbidden,
+		},
+		"encoded slash traversal": {
+			method:       http.MethodPost,
+			path:         "/extauthz/admin%2F..%2Fsubmissions",
+			expectedCode: http.StatusForbidden,
+		},
+		"encoded dot segment": {
+			method:       http.MethodPost,
+			path:         "/extauthz/admin/%2e%2e/submissions",
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	handler := http.StripPrefix("/extauthz", httpExtAuthzService(FakeUserProvider(func() (*User, error) {
+		return user, nil
+	}), rules))
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, httptest.NewRequest(tc.method, tc.path, nil))
+
+			if resp.Code != tc.expectedCode {
+				t.Fatalf("Got code %d, but expected %d: %s", resp.Code, tc.expectedCode, resp.Body.String())
+			}
+
+			if tc.expectedCode == http.StatusOK && resp.Header().Get(UserIDHeader) != user.ID {
+				t.Fatalf("Missing identity header")
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ module github.com/jhu-sheridan-libraries/jhuda-user-service
 go 1.13
 
 require (
+	github.com/go-asn1-ber/asn1-ber v1.5.1
+	github.com/go-ldap/ldap/v3 v3.2.4
 	github.com/go-test/deep v1.0.4
 	github.com/pkg/errors v0.8.1
 	github.com/urfave/cli/v2 v2.0.0
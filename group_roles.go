@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GroupRule grants roles to users who are members of matching groups.  Exactly
+// one of Group, Prefix, or Regex is expected to be given.
+type GroupRule struct {
+	Group  string   `json:"group,omitempty"`  // Exact group or entitlement URN
+	Prefix string   `json:"prefix,omitempty"` // Matches any group starting with this prefix
+	Regex  string   `json:"regex,omitempty"`  // Matches the entire group. Roles may refer to submatches, e.g. $1
+	Roles  []string `json:"roles"`            // Roles granted to members of matching groups
+
+	re *regexp.Regexp
+}
+
+// GroupRoles maps the groups and entitlements a user was released with (e.g. via
+// isMemberOf or eduPersonEntitlement) to roles.  Every matching rule contributes
+// its roles.
+type GroupRoles struct {
+	RoleBase string      `json:"-"` // BaseURI for roles
+	Rules    []GroupRule `json:"rules"`
+}
+
+// LoadGroupRoles reads JSON group role rules from the given file
+func LoadGroupRoles(path string) (*GroupRoles, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open group role file")
+	}
+	defer f.Close()
+
+	groupRoles, err := ReadGroupRoles(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read group role file %s", path)
+	}
+
+	return groupRoles, nil
+}
+
+// ReadGroupRoles decodes and validates JSON group role rules
+func ReadGroupRoles(r io.Reader) (*GroupRoles, error) {
+	var groupRoles GroupRoles
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&groupRoles); err != nil {
+		return nil, errors.Wrapf(err, "malformed group role rules")
+	}
+
+	if err := groupRoles.Compile(); err != nil {
+		return nil, err
+	}
+
+	return &groupRoles, nil
+}
+
+// Compile validates the rules and prepares any regular expressions.  Rules
+// constructed in code must be compiled before use.
+func (g *GroupRoles) Compile() error {
+	for i := range g.Rules {
+		rule := &g.Rules[i]
+
+		given := 0
+		for _, criterion := range []string{rule.Group, rule.Prefix, rule.Regex} {
+			if criterion != "" {
+				given++
+			}
+		}
+		if given != 1 {
+			return errors.Errorf("group rule %d must have exactly one of group, prefix, or regex", i)
+		}
+
+		if rule.Regex != "" {
+			re, err := regexp.Compile("^(?:" + rule.Regex + ")$")
+			if err != nil {
+				return errors.Wrapf(err, "bad regex in group rule %d", i)
+			}
+			rule.re = re
+		}
+	}
+
+	return nil
+}
+
+// Lookup finds the roles granted by all of the user's groups
+func (g *GroupRoles) Lookup(u *User) ([]Role, error) {
+	if u == nil {
+		return nil, nil
+	}
+
+	return g.rolesFor(u.Groups), nil
+}
+
+// rolesFor finds the roles granted by the given groups
+func (g *GroupRoles) rolesFor(groups []string) []Role {
+	var roles []Role
+
+	for _, group := range groups {
+		for _, rule := range g.Rules {
+			for _, name := range rule.match(group) {
+				roles = append(roles, Role{
+					Base: g.RoleBase,
+					Name: name,
+				})
+			}
+		}
+	}
+
+	return roles
+}
+
+func (r GroupRule) match(group string) []string {
+	switch {
+	case r.Group != "":
+		if group == r.Group {
+			return r.Roles
+		}
+	case r.Prefix != "":
+		if strings.HasPrefix(group, r.Prefix) {
+			return r.Roles
+		}
+	case r.re != nil:
+		submatches := r.re.FindStringSubmatchIndex(group)
+		if submatches == nil {
+			return nil
+		}
+
+		var names []string
+		for _, role := range r.Roles {
+			name := string(r.re.ExpandString(nil, role, group, submatches))
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestGroupRoles(t *testing.T) {
+	groupRoles, err := jhuda.LoadGroupRoles("testdata/group-roles.json")
+	if err != nil {
+		t.Fatalf("Could not load group roles: %v", err)
+	}
+
+	cases := map[string]struct {
+		groups   []string
+		expected []string
+	}{
+		"exact": {
+			groups:   []string{"urn:mace:example.org:groups:admins"},
+			expected: []string{"admin"},
+		},
+		"prefix": {
+			groups:   []string{"urn:mace:example.org:entitlement:pass"},
+			expected: []string{"submitter"},
+		},
+		"regex": {
+			groups:   []string{"urn:mace:example.org:groups:dept:library"},
+			expected: []string{"library-member"},
+		},
+		"regex must match whole group": {
+			groups: []string{"urn:mace:example.org:groups:dept:library:staff"},
+		},
+		"several groups": {
+			groups: []string{
+				"urn:mace:example.org:groups:dept:library",
+				"urn:mace:example.org:groups:admins",
+				"urn:mace:elsewhere.org:groups:admins",
+			},
+			expected: []string{"library-member", "admin"},
+		},
+		"no groups": {},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			roles, err := groupRoles.Lookup(&jhuda.User{Groups: tc.groups})
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+
+			var names []string
+			for _, role := range roles {
+				names = append(names, role.Simple())
+			}
+
+			diffs := deep.Equal(names, tc.expected)
+			if len(diffs) > 0 {
+				t.Fatalf("Did not get expected roles:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+func TestBadGroupRoles(t *testing.T) {
+	cases := map[string]string{
+		"malformed":      `{"rules": [`,
+		"no criteria":    `{"rules": [{"roles": ["admin"]}]}`,
+		"two criteria":   `{"rules": [{"group": "foo", "prefix": "bar", "roles": ["admin"]}]}`,
+		"bad regex":      `{"rules": [{"regex": "foo(", "roles": ["admin"]}]}`,
+		"unknown fields": `{"rules": [{"groups": "foo", "roles": ["admin"]}]}`,
+	}
+
+	for name, rules := range cases {
+		rules := rules
+		t.Run(name, func(t *testing.T) {
+			_, err := jhuda.ReadGroupRoles(strings.NewReader(rules))
+			if err == nil {
+				t.Fatalf("Expected error!")
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultSignatureHeader is the default header carrying the signature of the identity headers
+const DefaultSignatureHeader = "X-Identity-Signature"
+
+// DefaultSignatureMaxAge is how old, or far in the future, signatures may be by default
+const DefaultSignatureMaxAge = 5 * time.Minute
+
+// maxNonceLength limits the nonces remembered to detect replays
+const maxNonceLength = 128
+
+// HeaderSignature accepts identity headers only if the front-end proxy signs
+// them, so that nobody who can reach the service (even through a trusted
+// network) can forge an identity.  The signature header is of the form
+//
+//	keyId=<id>, ts=<unix seconds>, nonce=<random>, sig=<base64url HMAC-SHA256>
+//
+// where the HMAC is over the timestamp, nonce, and the values of each of the
+// identity headers (see signingString).  Any of the keys may sign, so that keys
+// can be rotated.  Signatures older than the max age are stale, and each nonce
+// may only be used once.
+type HeaderSignature struct {
+	Header  string            // Header carrying the signature, DefaultSignatureHeader if empty
+	Keys    map[string][]byte // Active keys, by key ID
+	Headers []string          // Identity headers covered by the signature
+	MaxAge  time.Duration     // Maximum age of signatures, DefaultSignatureMaxAge if zero
+
+	mu        sync.Mutex
+	nonces    map[string]time.Time // Nonces seen, and when they may be forgotten
+	lastPrune time.Time
+}
+
+// ParseSignatureKeys parses keys of the form id=secret
+func ParseSignatureKeys(keys []string) (map[string][]byte, error) {
+	parsed := map[string][]byte{}
+	for _, key := range keys {
+		parts := strings.SplitN(key, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("malformed signature key, expected 'id=secret'")
+		}
+		parsed[parts[0]] = []byte(parts[1])
+	}
+
+	return parsed, nil
+}
+
+// Sign gives the value of the signature header signing the given headers with
+// the given key, at the given time
+func (s *HeaderSignature) Sign(headers http.Header, keyID string, now time.Time) (string, error) {
+	key, ok := s.Keys[keyID]
+	if !ok {
+		return "", errors.Errorf("no signature key '%s'", keyID)
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", errors.Wrapf(err, "could not generate nonce")
+	}
+
+	ts := strconv.FormatInt(now.Unix(), 10)
+	nonce := hex.EncodeToString(random)
+
+	return "keyId=" + keyID + ", ts=" + ts + ", nonce=" + nonce + ", sig=" +
+		base64.RawURLEncoding.EncodeToString(s.mac(key, ts, nonce, headers)), nil
+}
+
+// Wrap rejects requests without a valid signature with 403, passing the rest
+// to the handler
+func (s *HeaderSignature) Wrap(next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Verify(r.Header, time.Now()); err != nil {
+			writeProblem(w, Problem{
+				Type:   ProblemInvalidSignature,
+				Title:  "Invalid identity signature",
+				Status: http.StatusForbidden,
+				Detail: err.Error(),
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Verify verifies the signature of the headers, as of the given time
+func (s *HeaderSignature) Verify(headers http.Header, now time.Time) error {
+	header := oneOf(s.Header, DefaultSignatureHeader)
+	value := headers.Get(header)
+	if value == "" {
+		return errors.Errorf("no signature in header %s", header)
+	}
+
+	params := map[string]string{}
+	for _, param := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("malformed signature")
+		}
+		params[parts[0]] = parts[1]
+	}
+
+	key, ok := s.Keys[params["keyId"]]
+	if !ok {
+		return errors.Errorf("unknown signature key '%s'", params["keyId"])
+	}
+
+	ts, err := strconv.ParseInt(params["ts"], 10, 64)
+	if err != nil {
+		return errors.Errorf("malformed signature timestamp '%s'", params["ts"])
+	}
+
+	nonce := params["nonce"]
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return errors.Errorf("missing or overlong signature nonce")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(params["sig"])
+	if err != nil || !hmac.Equal(sig, s.mac(key, params["ts"], nonce, headers)) {
+		return errors.Errorf("incorrect signature")
+	}
+
+	maxAge := s.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultSignatureMaxAge
+	}
+
+	signed := time.Unix(ts, 0)
+	if signed.Before(now.Add(-maxAge)) || signed.After(now.Add(maxAge)) {
+		return errors.Errorf("stale signature, signed at %s", signed.UTC().Format(time.RFC3339))
+	}
+
+	// Only verified nonces are remembered, so they cannot be exhausted by forgeries
+	if !s.remember(params["keyId"]+":"+nonce, signed.Add(maxAge), now) {
+		return errors.Errorf("replayed signature")
+	}
+
+	return nil
+}
+
+// remember remembers the nonce until it expires, or reports that it was
+// already seen
+func (s *HeaderSignature) remember(nonce string, expires, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nonces == nil {
+		s.nonces = map[string]time.Time{}
+	}
+
+	// Forget expired nonces, whose signatures are stale anyway
+	if now.Sub(s.lastPrune) > time.Second {
+		for n, exp := range s.nonces {
+			if now.After(exp) {
+				delete(s.nonces, n)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	if _, seen := s.nonces[nonce]; seen {
+		return false
+	}
+	s.nonces[nonce] = expires
+
+	return true
+}
+
+func (s *HeaderSignature) mac(key []byte, ts, nonce string, headers http.Header) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingString(ts, nonce, s.Headers, headers)))
+	return mac.Sum(nil)
+}
+
+// signingString gives the string that is signed: the timestamp, nonce, and a
+// line "name:value" for each identity header, in the given order, with the
+// name lowercased and multiple values joined by commas.  Absent headers have
+// empty values, so that they cannot be added to a signed request.
+func signingString(ts, nonce string, names []string, headers http.Header) string {
+	lines := []string{ts, nonce}
+	for _, name := range names {
+		values := headers[textproto.CanonicalMIMEHeaderKey(name)]
+		lines = append(lines, strings.ToLower(name)+":"+strings.Join(values, ","))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,205 @@
+package main_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestHeaderSignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	headers := []string{"Eppn", "Mail", "Ismemberof"}
+
+	signer := &jhuda.HeaderSignature{
+		Keys:    map[string][]byte{"new": []byte("n3w"), "old": []byte("0ld"), "other": []byte("other")},
+		Headers: headers,
+	}
+
+	cases := map[string]struct {
+		keyID   string
+		signed  time.Time
+		tamper  func(h http.Header)
+		replay  bool
+		invalid bool
+	}{
+		"valid": {
+			keyID: "new",
+		},
+		"rotated key": {
+			keyID: "old",
+		},
+		"unknown key": {
+			keyID:   "other",
+			invalid: true,
+		},
+		"slightly old": {
+			keyID:  "new",
+			signed: now.Add(-4 * time.Minute),
+		},
+		"stale": {
+			keyID:   "new",
+			signed:  now.Add(-6 * time.Minute),
+			invalid: true,
+		},
+		"future": {
+			keyID:   "new",
+			signed:  now.Add(6 * time.Minute),
+			invalid: true,
+		},
+		"replayed": {
+			keyID:   "new",
+			replay:  true,
+			invalid: true,
+		},
+		"changed header": {
+			keyID:   "new",
+			tamper:  func(h http.Header) { h.Set("Eppn", "admin@jhu.edu") },
+			invalid: true,
+		},
+		"added header": {
+			keyID:   "new",
+			tamper:  func(h http.Header) { h.Set("Mail", "admin@jhu.edu") },
+			invalid: true,
+		},
+		"added value": {
+			keyID:   "new",
+			tamper:  func(h http.Header) { h.Add("IsMemberOf", "admins") },
+			invalid: true,
+		},
+		"unsigned header": {
+			keyID:  "new",
+			tamper: func(h http.Header) { h.Set("Displayname", "Whoever") },
+		},
+		"missing signature": {
+			keyID:   "new",
+			tamper:  func(h http.Header) { h.Del(jhuda.DefaultSignatureHeader) },
+			invalid: true,
+		},
+		"malformed signature": {
+			keyID:   "new",
+			tamper:  func(h http.Header) { h.Set(jhuda.DefaultSignatureHeader, "keyId=new, ts, sig=abc") },
+			invalid: true,
+		},
+		"wrong signature": {
+			keyID: "new",
+			tamper: func(h http.Header) {
+				h.Set(jhuda.DefaultSignatureHeader, h.Get(jhuda.DefaultSignatureHeader)[:60]+"x")
+			},
+			invalid: true,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			verifier := &jhuda.HeaderSignature{
+				Keys:    map[string][]byte{"new": []byte("n3w"), "old": []byte("0ld")},
+				Headers: headers,
+			}
+
+			signed := tc.signed
+			if signed.IsZero() {
+				signed = now
+			}
+
+			h := http.Header{}
+			h.Set("Eppn", "bossman@jhu.edu")
+			h.Add("IsMemberOf", "staff")
+
+			value, err := signer.Sign(h, tc.keyID, signed)
+			if err != nil {
+				t.Fatalf("Could not sign: %v", err)
+			}
+			h.Set(jhuda.DefaultSignatureHeader, value)
+
+			if tc.tamper != nil {
+				tc.tamper(h)
+			}
+			if tc.replay {
+				if err := verifier.Verify(h, now); err != nil {
+					t.Fatalf("First use of signature should be valid: %v", err)
+				}
+			}
+
+			err = verifier.Verify(h, now)
+			if tc.invalid && err == nil {
+				t.Fatalf("Expected signature to be invalid")
+			}
+			if !tc.invalid && err != nil {
+				t.Fatalf("Expected signature to be valid: %v", err)
+			}
+		})
+	}
+}
+
+func TestHeaderSignatureWrap(t *testing.T) {
+	signature := &jhuda.HeaderSignature{
+		Header:  "X-Sig",
+		Keys:    map[string][]byte{"k": []byte("secret")},
+		Headers: []string{"Eppn"},
+	}
+
+	handler := signature.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	req.Header.Set("Eppn", "bossman@jhu.edu")
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusForbidden || resp.Header().Get("Content-Type") != jhuda.ProblemContentType {
+		t.Fatalf("Unsigned request should be forbidden, got %d", resp.Code)
+	}
+
+	value, _ := signature.Sign(req.Header, "k", time.Now())
+	req.Header.Set("X-Sig", value)
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("Signed request should be allowed, got %d", resp.Code)
+	}
+}
+
+func TestParseSignatureKeys(t *testing.T) {
+	keys, err := jhuda.ParseSignatureKeys([]string{"a=s3cret", "b=with=equals"})
+	if err != nil {
+		t.Fatalf("Could not parse keys: %v", err)
+	}
+
+	expected := map[string][]byte{"a": []byte("s3cret"), "b": []byte("with=equals")}
+	if diffs := deep.Equal(keys, expected); len(diffs) > 0 {
+		t.Fatalf("Wrong keys:\n%s", strings.Join(diffs, "\n"))
+	}
+
+	for _, bad := range []string{"nosecret", "=secret", "id="} {
+		if _, err := jhuda.ParseSignatureKeys([]string{bad}); err == nil {
+			t.Fatalf("Expected an error parsing '%s'", bad)
+		}
+	}
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	us := jhuda.UserService{
+		HeaderDefs: jhuda.ShibHeaders{
+			LocatorIDs: []string{"employeeNumber", "Eppn"},
+			Groups:     []string{},
+		},
+		IDs: jhuda.LocatorHeaderID{Header: "unique-id"},
+	}
+
+	expected := []string{
+		"Affiliation", "Displayname", "Employeenumber", "Eppn", "Givenname", "Mail", "Middlename", "Orcid",
+		"Shib-Identity-Provider", "Sn", "Uid", "Unique-Id", "Unscoped-Affiliation",
+	}
+
+	if diffs := deep.Equal(us.IdentityHeaders(), expected); len(diffs) > 0 {
+		t.Fatalf("Wrong identity headers:\n%s", strings.Join(diffs, "\n"))
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+)
+
+// ValueParser splits multi-valued header values.  Shibboleth joins multiple
+// values with a semicolon, and escapes literal semicolons within a value as \;
+type ValueParser struct {
+	Delimiter string // Separates values, default ;
+	Escape    string // Escapes a literal delimiter within a value, default \
+}
+
+// DefaultValueParser parses values the way Shibboleth joins them
+var DefaultValueParser = ValueParser{
+	Delimiter: ";",
+	Escape:    `\`,
+}
+
+// Split splits a header value into its individual values, removing escapes and
+// surrounding whitespace, and skipping any empty values.
+func (p ValueParser) Split(header string) []string {
+	delimiter := oneOf(p.Delimiter, DefaultValueParser.Delimiter)
+	escape := oneOf(p.Escape, DefaultValueParser.Escape)
+
+	var values []string
+	var current strings.Builder
+
+	add := func() {
+		if val := strings.TrimSpace(current.String()); val != "" {
+			values = append(values, val)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(header); {
+		switch {
+		case strings.HasPrefix(header[i:], escape+delimiter):
+			current.WriteString(delimiter)
+			i += len(escape) + len(delimiter)
+		case strings.HasPrefix(header[i:], delimiter):
+			add()
+			i += len(delimiter)
+		default:
+			current.WriteByte(header[i])
+			i++
+		}
+	}
+	add()
+
+	return values
+}
+
+// First returns the first of the values in the header, or an empty string
+func (p ValueParser) First(header string) string {
+	values := p.Split(header)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
@@ -0,0 +1,66 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestValueParser(t *testing.T) {
+	cases := map[string]struct {
+		parser   jhuda.ValueParser
+		header   string
+		expected []string
+	}{
+		"single": {
+			header:   "foo",
+			expected: []string{"foo"},
+		},
+		"multiple": {
+			header:   "foo;bar; baz ",
+			expected: []string{"foo", "bar", "baz"},
+		},
+		"escaped delimiter": {
+			header:   `foo\;bar;baz`,
+			expected: []string{"foo;bar", "baz"},
+		},
+		"lone escape": {
+			header:   `foo\bar;baz\`,
+			expected: []string{`foo\bar`, `baz\`},
+		},
+		"empty values": {
+			header:   ";foo;;bar;",
+			expected: []string{"foo", "bar"},
+		},
+		"empty": {
+			header: "",
+		},
+		"custom delimiter": {
+			parser:   jhuda.ValueParser{Delimiter: "$$", Escape: "%"},
+			header:   "foo$$bar%$$baz;qux",
+			expected: []string{"foo", "bar$$baz;qux"},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			diffs := deep.Equal(tc.parser.Split(tc.header), tc.expected)
+			if len(diffs) > 0 {
+				t.Fatalf("Did not get expected values:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+func TestValueParserFirst(t *testing.T) {
+	if first := (jhuda.ValueParser{}).First(`foo\;bar;baz`); first != "foo;bar" {
+		t.Fatalf("Got wrong first value: %s", first)
+	}
+
+	if first := (jhuda.ValueParser{}).First(""); first != "" {
+		t.Fatalf("Expected empty first value, got %s", first)
+	}
+}
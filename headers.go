@@ -1,19 +1,31 @@
 package main
 
 type ShibHeaders struct {
-	Displayname string
-	Email       string
-	Eppn        string
-	GivenName   string
-	LastName    string
-	LocatorIDs  []string
+	Displayname      string
+	Email            string
+	Eppn             string
+	GivenName        string
+	LastName         string
+	Middlename       string
+	Username         string
+	OrcidID          string // ORCID iD, bare or as a URI
+	IdentityProvider string // Entity ID of the user's IdP
+	LocatorIDs       []string
+	Groups           []string // Multi-valued group or entitlement headers, e.g. isMemberOf
+	Affiliation      []string // Multi-valued affiliation headers, the first with any values is used
 }
 
 var DefaultShibHeaders = ShibHeaders{
-	Displayname: "Displayname",
-	Email:       "Mail",
-	Eppn:        "Eppn",
-	GivenName:   "Givenname",
-	LastName:    "Sn",
-	LocatorIDs:  []string{"Employeenumber", "unique-id", "Eppn"},
+	Displayname:      "Displayname",
+	Email:            "Mail",
+	Eppn:             "Eppn",
+	GivenName:        "Givenname",
+	LastName:         "Sn",
+	Middlename:       "Middlename",
+	Username:         "Uid",
+	OrcidID:          "Orcid",
+	IdentityProvider: "Shib-Identity-Provider",
+	LocatorIDs:       []string{"Employeenumber", "unique-id", "Eppn"},
+	Groups:           []string{"Entitlement", "isMemberOf"},
+	Affiliation:      []string{"Affiliation", "unscoped-affiliation"},
 }
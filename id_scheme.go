@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// IDScheme determines the identifier of a user, which is appended to the
+// UserBase to form the User ID
+type IDScheme interface {
+	ID(eppn string, headers HeaderProvider) (string, error)
+}
+
+// EppnID identifies users by their eppn, as-is
+type EppnID struct{}
+
+// ID is the eppn
+func (EppnID) ID(eppn string, _ HeaderProvider) (string, error) {
+	return eppn, nil
+}
+
+// EscapedEppnID identifies users by their eppn, escaped as a URL path segment
+type EscapedEppnID struct{}
+
+// ID is the escaped eppn
+func (EscapedEppnID) ID(eppn string, _ HeaderProvider) (string, error) {
+	return url.PathEscape(eppn), nil
+}
+
+// HashedEppnID identifies users by the hex SHA-256 hash of their eppn, so that
+// eppns do not appear in IDs.  The salt, which is required and should be kept
+// secret, keeps IDs from being reversed by hashing guessed eppns.
+type HashedEppnID struct {
+	Salt string
+}
+
+// ID is the hash of the salted eppn
+func (h HashedEppnID) ID(eppn string, _ HeaderProvider) (string, error) {
+	if h.Salt == "" {
+		return "", errors.Errorf("hashed user IDs need a salt")
+	}
+
+	sum := sha256.Sum256([]byte(h.Salt + eppn))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// UUIDEppnID identifies users by a name-based (version 5) UUID of their eppn,
+// within a namespace
+type UUIDEppnID struct {
+	Namespace [16]byte
+}
+
+// URLNamespace is the RFC 4122 namespace for URLs, used for UUIDs when no other
+// namespace is given
+var URLNamespace = [16]byte{
+	0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1,
+	0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8,
+}
+
+// ID is the version 5 UUID of the eppn
+func (u UUIDEppnID) ID(eppn string, _ HeaderProvider) (string, error) {
+	h := sha1.New()
+	h.Write(u.Namespace[:])
+	h.Write([]byte(eppn))
+
+	var uuid [16]byte
+	copy(uuid[:], h.Sum(nil))
+	uuid[6] = (uuid[6] & 0x0f) | 0x50 // version 5
+	uuid[8] = (uuid[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return formatUUID(uuid), nil
+}
+
+// LocatorHeaderID identifies users by the value of a header, such as
+// eduPersonUniqueId, which unlike an eppn is never reassigned.  The value is
+// escaped as a URL path segment.
+type LocatorHeaderID struct {
+	Header string
+	Values ValueParser
+}
+
+// ID is the escaped value of the header
+func (l LocatorHeaderID) ID(_ string, headers HeaderProvider) (string, error) {
+	val := l.Values.First(headers.Get(l.Header))
+	if val == "" {
+		return "", ErrorMissingIdentity(fmt.Sprintf("Missing identifier header %s", l.Header))
+	}
+
+	return url.PathEscape(val), nil
+}
+
+// ParseUUID parses a UUID in its canonical hyphenated hex form
+func ParseUUID(s string) ([16]byte, error) {
+	var uuid [16]byte
+
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return uuid, errors.Errorf("malformed UUID '%s'", s)
+	}
+
+	digits := strings.Replace(s, "-", "", -1)
+	if _, err := hex.Decode(uuid[:], []byte(digits)); err != nil {
+		return uuid, errors.Wrapf(err, "malformed UUID '%s'", s)
+	}
+
+	return uuid, nil
+}
+
+func formatUUID(uuid [16]byte) string {
+	s := hex.EncodeToString(uuid[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
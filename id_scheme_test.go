@@ -0,0 +1,102 @@
+package main_test
+
+import (
+	"net/http"
+	"testing"
+
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestIDSchemes(t *testing.T) {
+	dns, err := jhuda.ParseUUID("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	if err != nil {
+		t.Fatalf("Could not parse namespace: %v", err)
+	}
+
+	cases := map[string]struct {
+		scheme   jhuda.IDScheme
+		headers  map[string][]string
+		expected string
+		invalid  bool
+	}{
+		"default": {
+			expected: "http://example.org/users/foo@jhu.edu",
+		},
+		"eppn": {
+			scheme:   jhuda.EppnID{},
+			expected: "http://example.org/users/foo@jhu.edu",
+		},
+		"escaped": {
+			scheme:   jhuda.EscapedEppnID{},
+			headers:  map[string][]string{"Eppn": {"foo/bar?@jhu.edu"}},
+			expected: "http://example.org/users/foo%2Fbar%3F@jhu.edu",
+		},
+		"salted hash": {
+			scheme:   jhuda.HashedEppnID{Salt: "salt"},
+			expected: "http://example.org/users/5ad722e73f09b9b5e5bf77240545bd91a6e470a543a09c342fe56a73012e33d1",
+		},
+		"uuid": {
+			scheme:   jhuda.UUIDEppnID{Namespace: jhuda.URLNamespace},
+			expected: "http://example.org/users/4f0ee7e4-aae7-5e34-ac0e-7b76670fe169",
+		},
+		"uuid in namespace": {
+			scheme:   jhuda.UUIDEppnID{Namespace: dns},
+			expected: "http://example.org/users/3ba1623e-0467-5af3-9aec-aed21ac4f171",
+		},
+		"locator": {
+			scheme:   jhuda.LocatorHeaderID{Header: "Unique-Id"},
+			headers:  map[string][]string{"Unique-Id": {"ABC123@jhu.edu;other"}},
+			expected: "http://example.org/users/ABC123@jhu.edu",
+		},
+		"missing locator": {
+			scheme:  jhuda.LocatorHeaderID{Header: "Unique-Id"},
+			invalid: true,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			headers := http.Header{"Eppn": {"foo@jhu.edu"}}
+			for k, v := range tc.headers {
+				headers[k] = v
+			}
+
+			user, err := jhuda.UserService{
+				UserBase: "http://example.org/users/",
+				IDs:      tc.scheme,
+			}.FromHeaders(headers)
+			if tc.invalid {
+				if _, ok := err.(jhuda.ErrorMissingIdentity); !ok {
+					t.Fatalf("Expected missing identity error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+
+			if user.ID != tc.expected {
+				t.Fatalf("Got ID %s, but expected %s", user.ID, tc.expected)
+			}
+			if user.Eppn != headers.Get("Eppn") {
+				t.Fatalf("Eppn should be unchanged, got %s", user.Eppn)
+			}
+		})
+	}
+}
+
+func TestParseUUID(t *testing.T) {
+	for _, bad := range []string{"", "6ba7b8109dad11d180b400c04fd430c8", "6ba7b810-9dad-11d1-80b4-00c04fd430cg", "6ba7b810-9dad-11d1-80b400-c04fd430c8"} {
+		if _, err := jhuda.ParseUUID(bad); err == nil {
+			t.Errorf("Expected '%s' to be invalid", bad)
+		}
+	}
+}
+
+func TestUnsaltedHashID(t *testing.T) {
+	_, err := jhuda.UserService{IDs: jhuda.HashedEppnID{}}.FromHeaders(http.Header{"Eppn": {"foo@jhu.edu"}})
+	if err == nil {
+		t.Fatalf("Expected an error for hashed IDs without a salt")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IdentityPolicy decides which identity providers (by entity ID) and eppn
+// domains (scopes) are accepted.  Anything denied is rejected, and if there is
+// an allow list, anything not on it is rejected too.
+type IdentityPolicy struct {
+	AllowedIdPs    []string // IdP entity IDs accepted, all if empty
+	DeniedIdPs     []string // IdP entity IDs rejected
+	AllowedDomains []string // Eppn domains accepted, with or without a leading @, all if empty
+	DeniedDomains  []string // Eppn domains rejected
+}
+
+// Check decides whether a user with the given eppn, from the given IdP, is
+// accepted
+func (p IdentityPolicy) Check(eppn, idp string) error {
+	if listed(p.DeniedIdPs, idp, strings.EqualFold) ||
+		(len(p.AllowedIdPs) > 0 && !listed(p.AllowedIdPs, idp, strings.EqualFold)) {
+		if idp == "" {
+			return ErrorForbiddenIdP("No identity provider given, and only specific identity providers are allowed")
+		}
+		return ErrorForbiddenIdP(fmt.Sprintf("Identity provider %s is not allowed", idp))
+	}
+
+	_, domain := splitEppn(eppn)
+	sameDomain := func(listed, domain string) bool {
+		return normalizeDomain(listed) == strings.ToLower(domain)
+	}
+
+	if listed(p.DeniedDomains, domain, sameDomain) ||
+		(len(p.AllowedDomains) > 0 && !listed(p.AllowedDomains, domain, sameDomain)) {
+		return ErrorForbiddenDomain(fmt.Sprintf("Eppn domain %s is not allowed", domain))
+	}
+
+	return nil
+}
+
+func listed(list []string, val string, equal func(listed, val string) bool) bool {
+	if val == "" {
+		return false
+	}
+
+	for _, l := range list {
+		if equal(l, val) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,116 @@
+package main_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestIdentityPolicy(t *testing.T) {
+	const jhu = "urn:mace:incommon:johnshopkins.edu"
+	const other = "https://idp.example.org/idp/shibboleth"
+
+	cases := map[string]struct {
+		policy   jhuda.IdentityPolicy
+		eppn     string
+		idp      string
+		expected error
+	}{
+		"no policy": {
+			eppn: "foo@example.org",
+		},
+		"allowed idp": {
+			policy: jhuda.IdentityPolicy{AllowedIdPs: []string{jhu}},
+			eppn:   "foo@jhu.edu",
+			idp:    jhu,
+		},
+		"idp not allowed": {
+			policy:   jhuda.IdentityPolicy{AllowedIdPs: []string{jhu}},
+			eppn:     "foo@jhu.edu",
+			idp:      other,
+			expected: jhuda.ErrorForbiddenIdP(""),
+		},
+		"no idp when only some allowed": {
+			policy:   jhuda.IdentityPolicy{AllowedIdPs: []string{jhu}},
+			eppn:     "foo@jhu.edu",
+			expected: jhuda.ErrorForbiddenIdP(""),
+		},
+		"denied idp": {
+			policy:   jhuda.IdentityPolicy{DeniedIdPs: []string{other}},
+			eppn:     "foo@example.org",
+			idp:      other,
+			expected: jhuda.ErrorForbiddenIdP(""),
+		},
+		"denied beats allowed": {
+			policy:   jhuda.IdentityPolicy{AllowedIdPs: []string{other}, DeniedIdPs: []string{other}},
+			eppn:     "foo@example.org",
+			idp:      other,
+			expected: jhuda.ErrorForbiddenIdP(""),
+		},
+		"allowed domain": {
+			policy: jhuda.IdentityPolicy{AllowedDomains: []string{"@jhu.edu"}},
+			eppn:   "foo@JHU.edu",
+		},
+		"domain not allowed": {
+			policy:   jhuda.IdentityPolicy{AllowedDomains: []string{"jhu.edu"}},
+			eppn:     "foo@example.org",
+			expected: jhuda.ErrorForbiddenDomain(""),
+		},
+		"denied domain": {
+			policy:   jhuda.IdentityPolicy{DeniedDomains: []string{"example.org"}},
+			eppn:     "foo@example.org",
+			idp:      other,
+			expected: jhuda.ErrorForbiddenDomain(""),
+		},
+		"allowed idp with denied domain": {
+			policy:   jhuda.IdentityPolicy{AllowedIdPs: []string{jhu}, DeniedDomains: []string{"jhmi.edu"}},
+			eppn:     "foo@jhmi.edu",
+			idp:      jhu,
+			expected: jhuda.ErrorForbiddenDomain(""),
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			headers := http.Header{"Eppn": {tc.eppn}}
+			if tc.idp != "" {
+				headers.Set("Shib-Identity-Provider", tc.idp)
+			}
+
+			user, err := jhuda.UserService{Identity: tc.policy}.FromHeaders(headers)
+			if tc.expected == nil {
+				if err != nil {
+					t.Fatalf("Got unexpected error: %v", err)
+				}
+				if user.IdentityProvider != tc.idp {
+					t.Fatalf("Got identity provider %s, but expected %s", user.IdentityProvider, tc.idp)
+				}
+				return
+			}
+
+			if fmt.Sprintf("%T", err) != fmt.Sprintf("%T", tc.expected) {
+				t.Fatalf("Expected a %T, but got %T: %v", tc.expected, err, err)
+			}
+		})
+	}
+}
+
+func TestIdentityProviderHeader(t *testing.T) {
+	user, err := jhuda.UserService{
+		HeaderDefs: jhuda.ShibHeaders{IdentityProvider: "Idp"},
+	}.FromHeaders(http.Header{
+		"Eppn":                   {"foo@jhu.edu"},
+		"Idp":                    {"urn:mace:incommon:johnshopkins.edu"},
+		"Shib-Identity-Provider": {"ignored"},
+	})
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+
+	if user.IdentityProvider != "urn:mace:incommon:johnshopkins.edu" {
+		t.Fatalf("Got wrong identity provider %s", user.IdentityProvider)
+	}
+}
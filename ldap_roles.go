@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+)
+
+// DefaultLdapGroupAttribute is the attribute listing a user entry's groups
+const DefaultLdapGroupAttribute = "memberOf"
+
+// DefaultLdapTimeout limits how long connecting to and searching LDAP may take
+const DefaultLdapTimeout = 10 * time.Second
+
+var ldapPlaceholder = regexp.MustCompile(`\{(\w+)(?::([^}]+))?\}`)
+
+// LdapRoles finds the groups a user belongs to in an LDAP or Active Directory
+// server, and maps them to roles.
+//
+// The search filter may contain placeholders, which are replaced by escaped values
+// from the user:
+//
+//	{eppn}             the full eppn, e.g. foo@jhu.edu
+//	{uid}              the local part of the eppn, e.g. foo
+//	{domain}           the domain of the eppn, e.g. jhu.edu
+//	{locator:<header>} the value of the locator ID from the given header, e.g. {locator:Employeenumber}
+//
+// If any placeholder has no value for a user, no search is done and the user
+// gets no roles.
+type LdapRoles struct {
+	URL            string        // LDAP server URL, e.g. ldaps://ldap.example.org
+	BindDN         string        // DN to bind as, anonymous if empty
+	BindPassword   string        // Password for BindDN
+	BaseDN         string        // Base DN of the search
+	Filter         string        // Search filter with placeholders, e.g. (eduPersonPrincipalName={eppn})
+	GroupAttribute string        // Attribute of matching entries with group names or DNs, default memberOf
+	Timeout        time.Duration // Connection and search timeout, default 10 seconds
+	RoleBase       string        // BaseURI for roles
+
+	// Mapping maps groups to roles.  If nil, each group is a role.  Groups given
+	// as DNs become roles named by the value of their first RDN, e.g. the cn.
+	Mapping *GroupRoles
+}
+
+// Lookup searches LDAP for the user's groups
+func (l *LdapRoles) Lookup(u *User) ([]Role, error) {
+	if u == nil {
+		return nil, nil
+	}
+
+	filter, ok := l.filter(u)
+	if !ok {
+		return nil, nil
+	}
+
+	groups, err := l.search(filter)
+	if err != nil {
+		return nil, errors.Wrapf(err, "LDAP search for %s failed", filter)
+	}
+
+	if l.Mapping != nil {
+		return l.Mapping.rolesFor(groups), nil
+	}
+
+	var roles []Role
+	for _, group := range groups {
+		roles = append(roles, Role{
+			Base: l.RoleBase,
+			Name: groupName(group),
+		})
+	}
+
+	return roles, nil
+}
+
+func (l *LdapRoles) search(filter string) ([]string, error) {
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = DefaultLdapTimeout
+	}
+
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not connect to %s", l.URL)
+	}
+	defer conn.Close()
+	conn.SetTimeout(timeout)
+
+	if l.BindDN != "" {
+		if err = conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			return nil, errors.Wrapf(err, "could not bind as %s", l.BindDN)
+		}
+	}
+
+	attribute := oneOf(l.GroupAttribute, DefaultLdapGroupAttribute)
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		int(timeout/time.Second),
+		false,
+		filter,
+		[]string{attribute},
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.GetEqualFoldAttributeValues(attribute)...)
+	}
+
+	return groups, nil
+}
+
+// filter expands the placeholders in the search filter for the given user
+func (l *LdapRoles) filter(u *User) (string, bool) {
+	ok := true
+
+	filter := ldapPlaceholder.ReplaceAllStringFunc(l.Filter, func(placeholder string) string {
+		match := ldapPlaceholder.FindStringSubmatch(placeholder)
+
+		var val string
+		uid, domain := splitEppn(u.Eppn)
+
+		switch match[1] {
+		case "eppn":
+			val = u.Eppn
+		case "uid":
+			val = uid
+		case "domain":
+			val = domain
+		case "locator":
+			val = locatorValue(u, match[2])
+		default:
+			return placeholder
+		}
+
+		if val == "" {
+			ok = false
+		}
+
+		return ldap.EscapeFilter(val)
+	})
+
+	return filter, ok
+}
+
+// splitEppn splits an eppn into its local part and domain
+func splitEppn(eppn string) (string, string) {
+	i := strings.LastIndex(eppn, "@")
+	if i < 0 {
+		return eppn, ""
+	}
+
+	return eppn[:i], eppn[i+1:]
+}
+
+// locatorValue finds the first value of the given locator header, or failing
+// that the value of the first locator ID from the header, in the default format
+func locatorValue(u *User, header string) string {
+	for h, values := range u.Locators {
+		if strings.EqualFold(h, header) && len(values) > 0 {
+			return values[0]
+		}
+	}
+
+	for _, locator := range u.Locatorids {
+		parts := strings.SplitN(locator, ":", 3)
+		if len(parts) == 3 && strings.EqualFold(parts[1], header) {
+			return parts[2]
+		}
+	}
+
+	return ""
+}
+
+// groupName uses the value of the first RDN of a group DN as its name, e.g.
+// cn=admins,ou=groups,dc=example,dc=org is admins.  Anything else is used as-is.
+func groupName(group string) string {
+	dn, err := ldap.ParseDN(group)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+		return group
+	}
+
+	return dn.RDNs[0].Attributes[0].Value
+}
@@ -0,0 +1,290 @@
+package main_test
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/go-test/deep"
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+// FakeLdap is a minimal in-process LDAP server.  It understands simple binds and
+// searches, and answers searches with the entries registered for the exact filter.
+type FakeLdap struct {
+	BindDN   string
+	Password string
+	Entries  map[string][]*ldap.Entry // Search results, by filter
+
+	listener net.Listener
+	mutex    sync.Mutex
+	searches []string
+}
+
+func startFakeLdap(t *testing.T, f *FakeLdap) *FakeLdap {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Could not start fake LDAP server: %v", err)
+	}
+	f.listener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *FakeLdap) URL() string {
+	return "ldap://" + f.listener.Addr().String()
+}
+
+func (f *FakeLdap) Close() {
+	_ = f.listener.Close()
+}
+
+func (f *FakeLdap) Searches() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.searches...)
+}
+
+func (f *FakeLdap) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			code := uint16(ldap.LDAPResultSuccess)
+			if op.Children[1].Value.(string) != f.BindDN || op.Children[2].Data.String() != f.Password {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			f.respond(conn, id, ldap.ApplicationBindResponse, code)
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				f.respond(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultOperationsError)
+				continue
+			}
+
+			f.mutex.Lock()
+			f.searches = append(f.searches, filter)
+			f.mutex.Unlock()
+
+			for _, entry := range f.Entries[filter] {
+				f.write(conn, id, encodeEntry(entry))
+			}
+			f.respond(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+		default:
+			return
+		}
+	}
+}
+
+func (f *FakeLdap) respond(conn net.Conn, id int64, tag ber.Tag, code uint16) {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(code), "Result code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic message"))
+	f.write(conn, id, result)
+}
+
+func (f *FakeLdap) write(conn net.Conn, id int64, op *ber.Packet) {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	envelope.AppendChild(op)
+	_, _ = conn.Write(envelope.Bytes())
+}
+
+func encodeEntry(entry *ldap.Entry) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "DN"))
+
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, attr := range entry.Attributes {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attr.Name, "Name"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, val := range attr.Values {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, val, "Value"))
+		}
+		attribute.AppendChild(values)
+		attributes.AppendChild(attribute)
+	}
+	packet.AppendChild(attributes)
+
+	return packet
+}
+
+func TestLdapRoles(t *testing.T) {
+	directory := FakeLdap{
+		BindDN:   "cn=service,dc=example,dc=org",
+		Password: "secret",
+		Entries: map[string][]*ldap.Entry{
+			"(eduPersonPrincipalName=foo@example.org)": {{
+				DN: "uid=foo,ou=people,dc=example,dc=org",
+				Attributes: []*ldap.EntryAttribute{{
+					Name:   "memberOf",
+					Values: []string{"cn=admins,ou=groups,dc=example,dc=org", "cn=staff,ou=groups,dc=example,dc=org"},
+				}},
+			}},
+			"(&(uid=bar)(employeeNumber=123))": {{
+				DN: "uid=bar,ou=people,dc=example,dc=org",
+				Attributes: []*ldap.EntryAttribute{{
+					Name:   "isMemberOf",
+					Values: []string{"library"},
+				}},
+			}},
+		},
+	}
+
+	cases := map[string]struct {
+		lookup   jhuda.LdapRoles
+		user     *jhuda.User
+		expected []string
+		searches []string
+	}{
+		"group DNs": {
+			lookup: jhuda.LdapRoles{
+				Filter: "(eduPersonPrincipalName={eppn})",
+			},
+			user:     &jhuda.User{Eppn: "foo@example.org"},
+			expected: []string{"admins", "staff"},
+			searches: []string{"(eduPersonPrincipalName=foo@example.org)"},
+		},
+		"mapped groups": {
+			lookup: jhuda.LdapRoles{
+				Filter: "(eduPersonPrincipalName={eppn})",
+				Mapping: &jhuda.GroupRoles{
+					Rules: []jhuda.GroupRule{{
+						Group: "cn=admins,ou=groups,dc=example,dc=org",
+						Roles: []string{"admin"},
+					}},
+				},
+			},
+			user:     &jhuda.User{Eppn: "foo@example.org"},
+			expected: []string{"admin"},
+			searches: []string{"(eduPersonPrincipalName=foo@example.org)"},
+		},
+		"uid and locator": {
+			lookup: jhuda.LdapRoles{
+				Filter:         "(&(uid={uid})(employeeNumber={locator:Employeenumber}))",
+				GroupAttribute: "ismemberof",
+			},
+			user: &jhuda.User{
+				Eppn:       "bar@example.org",
+				Locatorids: []string{"example.org:Employeenumber:123"},
+			},
+			expected: []string{"library"},
+			searches: []string{"(&(uid=bar)(employeeNumber=123))"},
+		},
+		"locator header value": {
+			lookup: jhuda.LdapRoles{
+				Filter:         "(&(uid={uid})(employeeNumber={locator:Employeenumber}))",
+				GroupAttribute: "ismemberof",
+			},
+			user: &jhuda.User{
+				Eppn:       "bar@example.org",
+				Locatorids: []string{"urn:employeeid:123"},
+				Locators:   map[string][]string{"Employeenumber": {"123"}},
+			},
+			expected: []string{"library"},
+			searches: []string{"(&(uid=bar)(employeeNumber=123))"},
+		},
+		"missing locator": {
+			lookup: jhuda.LdapRoles{
+				Filter: "(employeeNumber={locator:Employeenumber})",
+			},
+			user: &jhuda.User{Eppn: "bar@example.org"},
+		},
+		"escaped values": {
+			lookup: jhuda.LdapRoles{
+				Filter: "(eduPersonPrincipalName={eppn})",
+			},
+			user:     &jhuda.User{Eppn: "*)(uid=foo@example.org"},
+			searches: []string{`(eduPersonPrincipalName=\2a\29\28uid=foo@example.org)`},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			server := startFakeLdap(t, &FakeLdap{
+				BindDN:   directory.BindDN,
+				Password: directory.Password,
+				Entries:  directory.Entries,
+			})
+			defer server.Close()
+
+			tc.lookup.URL = server.URL()
+			tc.lookup.BindDN = server.BindDN
+			tc.lookup.BindPassword = server.Password
+			tc.lookup.BaseDN = "dc=example,dc=org"
+
+			roles, err := tc.lookup.Lookup(tc.user)
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+
+			var names []string
+			for _, role := range roles {
+				names = append(names, role.Simple())
+			}
+
+			diffs := deep.Equal(names, tc.expected)
+			if len(diffs) > 0 {
+				t.Fatalf("Did not get expected roles:\n%s", strings.Join(diffs, "\n"))
+			}
+
+			diffs = deep.Equal(server.Searches(), tc.searches)
+			if len(diffs) > 0 {
+				t.Fatalf("Did not perform expected searches:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+func TestLdapRolesErrors(t *testing.T) {
+	server := startFakeLdap(t, &FakeLdap{
+		BindDN:   "cn=service,dc=example,dc=org",
+		Password: "secret",
+	})
+	defer server.Close()
+
+	user := &jhuda.User{Eppn: "foo@example.org"}
+
+	_, err := (&jhuda.LdapRoles{
+		URL:          server.URL(),
+		BindDN:       server.BindDN,
+		BindPassword: "wrong",
+		Filter:       "(eduPersonPrincipalName={eppn})",
+	}).Lookup(user)
+	if err == nil {
+		t.Fatalf("Expected error for bad credentials")
+	}
+
+	_, err = (&jhuda.LdapRoles{
+		URL:    "ldap://localhost:1",
+		Filter: "(eduPersonPrincipalName={eppn})",
+	}).Lookup(user)
+	if err == nil {
+		t.Fatalf("Expected error for unreachable server")
+	}
+}
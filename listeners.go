@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// UnixPrefix marks listen addresses that are unix socket paths, e.g.
+// unix:/run/user-service.sock
+const UnixPrefix = "unix:"
+
+// DefaultSocketMode is the default permissions of unix sockets, allowing the
+// owner and group (e.g. the web server) to connect
+const DefaultSocketMode os.FileMode = 0660
+
+// listen listens on a TCP address such as :8091, or a unix socket path with
+// the given permissions.  A stale socket left from an unclean exit is replaced.
+func listen(address string, mode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(address, UnixPrefix) {
+		l, err := net.Listen("tcp", address)
+		return l, errors.Wrapf(err, "could not listen on %s", address)
+	}
+
+	path := strings.TrimPrefix(address, UnixPrefix)
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("could not listen on %s, which exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrapf(err, "could not remove stale socket %s", path)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not listen on %s", path)
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, errors.Wrapf(err, "could not set permissions of %s", path)
+	}
+
+	return l, nil
+}
+
+// parseSocketMode parses octal permissions, e.g. 0660
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return DefaultSocketMode, nil
+	}
+
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, errors.Errorf("malformed socket mode '%s', expected octal permissions like 0660", mode)
+	}
+
+	return os.FileMode(m), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+)
+
+// DefaultLocatorTemplate forms locator IDs like johnshopkins.edu:Employeenumber:123
+const DefaultLocatorTemplate = "{domain}:{name}:{value}"
+
+// LocatorFormat determines how locator IDs are formed from the values of
+// locator headers.  The template may contain the placeholders
+//
+//	{domain} the scope of the value, if scoped, otherwise the eppn domain
+//	{name}   the alias of the locator header, or the header itself
+//	{value}  the value, without any scope
+type LocatorFormat struct {
+	Template string            // Template for locator IDs, DefaultLocatorTemplate if empty
+	Aliases  map[string]string // Names used for locator headers, by header (case insensitive)
+	Scoped   []string          // Headers whose values are scoped, e.g. 123@jhu.edu
+}
+
+// Format forms the locator ID for a value of the given header
+func (f LocatorFormat) Format(header, value, eppnDomain string) string {
+	domain := eppnDomain
+	if f.scoped(header) {
+		if local, scope := splitEppn(value); scope != "" {
+			value, domain = local, scope
+		}
+	}
+
+	return strings.NewReplacer(
+		"{domain}", domain,
+		"{name}", f.name(header),
+		"{value}", value,
+	).Replace(oneOf(f.Template, DefaultLocatorTemplate))
+}
+
+func (f LocatorFormat) name(header string) string {
+	for h, alias := range f.Aliases {
+		if strings.EqualFold(h, header) {
+			return alias
+		}
+	}
+
+	return header
+}
+
+func (f LocatorFormat) scoped(header string) bool {
+	for _, h := range f.Scoped {
+		if strings.EqualFold(h, header) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -17,6 +17,8 @@ func run(args []string) {
 		Usage: "Provides an http endpoint for determining user info based on shibboleth headers",
 		Commands: []*cli.Command{
 			serve(),
+			explain(),
+			sign(),
 		},
 	}
 
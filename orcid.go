@@ -0,0 +1,54 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// OrcidBase is the prefix of normalized ORCID iDs
+const OrcidBase = "https://orcid.org/"
+
+var orcidPattern = regexp.MustCompile(`^(\d{4})-?(\d{4})-?(\d{4})-?(\d{3}[\dX])$`)
+
+// NormalizeOrcid validates an ORCID iD, given either bare (0000-0002-1825-0097)
+// or as a URI, and returns it in the https://orcid.org/0000-0002-1825-0097 form
+func NormalizeOrcid(orcid string) (string, error) {
+	id := strings.TrimSpace(orcid)
+	for _, prefix := range []string{"https://", "http://"} {
+		if len(id) >= len(prefix) && strings.EqualFold(id[:len(prefix)], prefix) {
+			id = id[len(prefix):]
+		}
+	}
+	if len(id) >= len("orcid.org/") && strings.EqualFold(id[:len("orcid.org/")], "orcid.org/") {
+		id = id[len("orcid.org/"):]
+	}
+
+	parts := orcidPattern.FindStringSubmatch(strings.ToUpper(id))
+	if parts == nil {
+		return "", errors.Errorf("malformed ORCID iD '%s'", orcid)
+	}
+
+	digits := strings.Join(parts[1:], "")
+	if orcidChecksum(digits[:15]) != digits[15] {
+		return "", errors.Errorf("ORCID iD '%s' has an invalid checksum", orcid)
+	}
+
+	return OrcidBase + strings.Join(parts[1:], "-"), nil
+}
+
+// orcidChecksum calculates the ISO 7064 11,2 check digit of the given base digits
+func orcidChecksum(digits string) byte {
+	total := 0
+	for _, d := range digits {
+		total = (total + int(d-'0')) * 2
+	}
+
+	result := (12 - total%11) % 11
+	if result == 10 {
+		return 'X'
+	}
+
+	return byte('0' + result)
+}
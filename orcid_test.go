@@ -0,0 +1,71 @@
+package main_test
+
+import (
+	"testing"
+
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestNormalizeOrcid(t *testing.T) {
+	cases := map[string]struct {
+		orcid    string
+		expected string
+		invalid  bool
+	}{
+		"bare": {
+			orcid:    "0000-0002-1825-0097",
+			expected: "https://orcid.org/0000-0002-1825-0097",
+		},
+		"uri": {
+			orcid:    "https://orcid.org/0000-0002-1825-0097",
+			expected: "https://orcid.org/0000-0002-1825-0097",
+		},
+		"http uri": {
+			orcid:    "http://ORCID.org/0000-0002-1825-0097",
+			expected: "https://orcid.org/0000-0002-1825-0097",
+		},
+		"no hyphens": {
+			orcid:    " 0000000218250097 ",
+			expected: "https://orcid.org/0000-0002-1825-0097",
+		},
+		"X check digit": {
+			orcid:    "0000-0002-1694-233x",
+			expected: "https://orcid.org/0000-0002-1694-233X",
+		},
+		"bad checksum": {
+			orcid:   "0000-0002-1825-0098",
+			invalid: true,
+		},
+		"too short": {
+			orcid:   "0000-0002-1825-009",
+			invalid: true,
+		},
+		"other host": {
+			orcid:   "https://example.org/0000-0002-1825-0097",
+			invalid: true,
+		},
+		"not an orcid": {
+			orcid:   "bogus",
+			invalid: true,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			orcid, err := jhuda.NormalizeOrcid(tc.orcid)
+			if tc.invalid {
+				if err == nil {
+					t.Fatalf("Expected %s to be invalid, but got %s", tc.orcid, orcid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+			if orcid != tc.expected {
+				t.Fatalf("Got %s, but expected %s", orcid, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PathRule gives the roles required to access paths under a prefix
+type PathRule struct {
+	Prefix    string   `json:"prefix"`              // Path prefix, matching whole path segments
+	Methods   []string `json:"methods,omitempty"`   // HTTP methods the rule applies to, all if empty
+	Roles     []string `json:"roles,omitempty"`     // Roles required, all of which the user must have
+	Anonymous bool     `json:"anonymous,omitempty"` // Allow access without any identity
+}
+
+// PathRules decides which rule applies to a request by its method and path.  The
+// rule with the longest matching prefix wins.  Requests matching no rule are denied.
+//
+//	{
+//	  "rules": [
+//	    {"prefix": "/", "roles": []},
+//	    {"prefix": "/admin", "roles": ["admin"]},
+//	    {"prefix": "/submissions", "methods": ["POST", "PUT"], "roles": ["submitter"]},
+//	    {"prefix": "/public", "anonymous": true}
+//	  ]
+//	}
+type PathRules struct {
+	Rules []PathRule `json:"rules"`
+}
+
+// LoadPathRules reads JSON path rules from the given file
+func LoadPathRules(file string) (*PathRules, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open path rules file")
+	}
+	defer f.Close()
+
+	rules, err := ReadPathRules(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read path rules file %s", file)
+	}
+
+	return rules, nil
+}
+
+// ReadPathRules decodes and validates JSON path rules
+func ReadPathRules(r io.Reader) (*PathRules, error) {
+	var rules PathRules
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return nil, errors.Wrapf(err, "malformed path rules")
+	}
+
+	for i, rule := range rules.Rules {
+		if !strings.HasPrefix(rule.Prefix, "/") {
+			return nil, errors.Errorf("path rule %d prefix must start with /, got '%s'", i, rule.Prefix)
+		}
+		if rule.Anonymous && len(rule.Roles) > 0 {
+			return nil, errors.Errorf("path rule %d for %s cannot both allow anonymous access and require roles", i, rule.Prefix)
+		}
+	}
+
+	return &rules, nil
+}
+
+// Match finds the rule for the given method and path, or nil if none apply.
+// The path is cleaned first, so that e.g. /public/../admin is matched as /admin.
+// It must already be decoded, and free of encoded slashes (see requestPath).
+func (p *PathRules) Match(method, requestPath string) *PathRule {
+	requestPath = path.Clean("/" + requestPath)
+
+	var match *PathRule
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.appliesTo(method) || !underPrefix(requestPath, rule.Prefix) {
+			continue
+		}
+		if match == nil || len(rule.Prefix) > len(match.Prefix) {
+			match = rule
+		}
+	}
+
+	return match
+}
+
+func (r *PathRule) appliesTo(method string) bool {
+	if len(r.Methods) == 0 {
+		return true
+	}
+
+	for _, m := range r.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// underPrefix determines if the path is the prefix, or beneath it
+func underPrefix(requestPath, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" ||
+		requestPath == prefix ||
+		strings.HasPrefix(requestPath, prefix+"/")
+}
@@ -0,0 +1,70 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestPathRules(t *testing.T) {
+	rules, err := jhuda.LoadPathRules("testdata/path-rules.json")
+	if err != nil {
+		t.Fatalf("Could not load path rules: %v", err)
+	}
+
+	cases := []struct {
+		method   string
+		path     string
+		expected string
+	}{
+		{"GET", "/", "/"},
+		{"GET", "/foo/bar", "/"},
+		{"GET", "/admin", "/admin"},
+		{"GET", "/admin/users", "/admin"},
+		{"GET", "/administrator", "/"},
+		{"GET", "/public/../admin", "/admin"},
+		{"GET", "//admin", "/admin"},
+		{"GET", "/submissions/1", "/"},
+		{"POST", "/submissions/1", "/submissions"},
+		{"put", "/submissions", "/submissions"},
+		{"GET", "/public", "/public/"},
+		{"GET", "/public/index.html", "/public/"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			rule := rules.Match(tc.method, tc.path)
+			if rule == nil {
+				t.Fatalf("No rule matched")
+			}
+			if rule.Prefix != tc.expected {
+				t.Fatalf("Expected rule for %s, got %s", tc.expected, rule.Prefix)
+			}
+		})
+	}
+
+	restricted := jhuda.PathRules{Rules: []jhuda.PathRule{{Prefix: "/admin"}}}
+	if rule := restricted.Match("GET", "/foo"); rule != nil {
+		t.Fatalf("Expected no rule to match, got %s", rule.Prefix)
+	}
+}
+
+func TestBadPathRules(t *testing.T) {
+	cases := map[string]string{
+		"malformed":         `{"rules": [`,
+		"relative prefix":   `{"rules": [{"prefix": "admin"}]}`,
+		"anonymous roles":   `{"rules": [{"prefix": "/", "anonymous": true, "roles": ["admin"]}]}`,
+		"unknown attribute": `{"rules": [{"path": "/"}]}`,
+	}
+
+	for name, rules := range cases {
+		rules := rules
+		t.Run(name, func(t *testing.T) {
+			if _, err := jhuda.ReadPathRules(strings.NewReader(rules)); err == nil {
+				t.Fatalf("Expected error!")
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// ProblemContentType is the media type of RFC 7807 problem details
+const ProblemContentType = "application/problem+json"
+
+// Problem types, identifying the kinds of error responses
+const (
+	ProblemMissingIdentity  = "urn:jhuda:problem:missing-identity"
+	ProblemInvalidIdentity  = "urn:jhuda:problem:invalid-identity"
+	ProblemForbiddenDomain  = "urn:jhuda:problem:forbidden-domain"
+	ProblemForbiddenIdP     = "urn:jhuda:problem:forbidden-identity-provider"
+	ProblemMissingRoles     = "urn:jhuda:problem:missing-roles"
+	ProblemNoAccessRule     = "urn:jhuda:problem:no-access-rule"
+	ProblemAmbiguousPath    = "urn:jhuda:problem:ambiguous-path"
+	ProblemUntrustedProxy   = "urn:jhuda:problem:untrusted-proxy"
+	ProblemInvalidSignature = "urn:jhuda:problem:invalid-signature"
+	ProblemUpstreamFailure  = "urn:jhuda:problem:upstream-failure"
+	ProblemInternal         = "urn:jhuda:problem:internal"
+)
+
+// Problem is an RFC 7807 problem details error response body
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// errorProblem describes an error from resolving a user as a problem.  Server
+// errors have a fixed detail, so that they do not reveal internals.
+func errorProblem(err error) Problem {
+	switch errors.Cause(err).(type) {
+	case ErrorMissingIdentity:
+		return Problem{ProblemMissingIdentity, "Missing identity", http.StatusUnauthorized, err.Error()}
+	case ErrorBadInput:
+		return Problem{ProblemInvalidIdentity, "Invalid identity", http.StatusBadRequest, err.Error()}
+	case ErrorForbiddenDomain:
+		return Problem{ProblemForbiddenDomain, "Forbidden domain", http.StatusForbidden, err.Error()}
+	case ErrorForbiddenIdP:
+		return Problem{ProblemForbiddenIdP, "Forbidden identity provider", http.StatusForbidden, err.Error()}
+	case ErrorUpstream:
+		return Problem{ProblemUpstreamFailure, "Upstream failure", http.StatusBadGateway, "A service the user service depends on failed"}
+	default:
+		return Problem{ProblemInternal, "Internal error", http.StatusInternalServerError, "The user service failed"}
+	}
+}
+
+// tokenProblem describes a failure to issue an identity token, whose cause is
+// logged rather than revealed
+var tokenProblem = Problem{ProblemInternal, "Internal error", http.StatusInternalServerError, "Could not issue an identity token"}
+
+// authProblem describes an error from resolving a user for an authorization
+// endpoint.  Reverse proxies understand only 401 and 403 as denials, so an
+// invalid identity is unauthorized rather than a bad request.
+func authProblem(err error) Problem {
+	p := errorProblem(err)
+	if p.Status == http.StatusBadRequest {
+		p.Status = http.StatusUnauthorized
+	}
+
+	return p
+}
+
+// identityError determines if the error is due to a lacking identity, rather
+// than a failure of the service
+func identityError(err error) bool {
+	switch errors.Cause(err).(type) {
+	case ErrorMissingIdentity, ErrorBadInput, ErrorForbiddenDomain, ErrorForbiddenIdP:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeProblem writes the problem as the response
+func writeProblem(w http.ResponseWriter, p Problem) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Printf("Error encoding problem response %v", err)
+	}
+}
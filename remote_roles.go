@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultRemoteTimeout limits how long each request to a remote role service may take
+const DefaultRemoteTimeout = 5 * time.Second
+
+// maxRemoteResponse limits the size of remote role service responses
+const maxRemoteResponse = 1 << 20
+
+// ErrorCircuitOpen is returned when a circuit breaker rejects a call
+type ErrorCircuitOpen string
+
+func (e ErrorCircuitOpen) Error() string {
+	return string(e)
+}
+
+// RemoteRoles delegates role decisions to a separate HTTP service.  The user is
+// POSTed as JSON (as in User.Serialize), and the service is expected to respond
+// with a JSON array of role names, e.g. ["admin", "submitter"].
+//
+// Failed requests (connection errors, 5xx or 429 responses) are retried with
+// exponential backoff.  Other responses are not retried.
+type RemoteRoles struct {
+	URL      string          // URL of the remote role service
+	Client   *http.Client    // HTTP client, default has a timeout of Timeout
+	Timeout  time.Duration   // Timeout of each request, default 5 seconds
+	Retries  int             // Number of times to retry a failed request
+	Backoff  time.Duration   // Delay before the first retry, doubled for every subsequent one
+	RoleBase string          // BaseURI for roles
+	Breaker  *CircuitBreaker // Stops calling the remote service while it is failing, optional
+}
+
+// Lookup asks the remote service for the user's roles
+func (r *RemoteRoles) Lookup(u *User) ([]Role, error) {
+	if u == nil {
+		return nil, nil
+	}
+
+	var body bytes.Buffer
+	if err := u.Serialize(&body); err != nil {
+		return nil, errors.Wrapf(err, "could not serialize user")
+	}
+
+	var names []string
+	err := r.Breaker.Call(func() error {
+		var err error
+		names, err = r.retry(body.Bytes())
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "remote role lookup at %s failed", r.URL)
+	}
+
+	var roles []Role
+	for _, name := range names {
+		roles = append(roles, Role{
+			Base: r.RoleBase,
+			Name: name,
+		})
+	}
+
+	return roles, nil
+}
+
+func (r *RemoteRoles) retry(body []byte) ([]string, error) {
+	backoff := r.Backoff
+
+	for attempt := 0; ; attempt++ {
+		names, retryable, err := r.post(body)
+		if err == nil || !retryable || attempt >= r.Retries {
+			return names, err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends the user to the remote service, and determines if any failure
+// is worth retrying
+func (r *RemoteRoles) post(body []byte) ([]string, bool, error) {
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: r.Timeout}
+		if client.Timeout == 0 {
+			client.Timeout = DefaultRemoteTimeout
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json;charset=utf-8")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxRemoteResponse))
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retryable, errors.Errorf("remote role service responded with %d", resp.StatusCode)
+	}
+
+	var names []string
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRemoteResponse)).Decode(&names); err != nil {
+		return nil, false, errors.Wrapf(err, "malformed remote role service response")
+	}
+
+	return names, false, nil
+}
+
+// CircuitBreaker stops calls to a failing service.  After Threshold consecutive
+// failures the circuit opens, and calls are rejected without being attempted until
+// Cooldown has passed.  Then, a single trial call is let through; if it succeeds
+// the circuit closes, otherwise it opens again.
+//
+// A nil CircuitBreaker, or one without a positive Threshold, never rejects calls.
+type CircuitBreaker struct {
+	Threshold int           // Consecutive failures that open the circuit
+	Cooldown  time.Duration // Time the circuit stays open
+
+	mutex    sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool // Whether a trial call is in progress
+}
+
+// Call calls the given function, unless the circuit is open
+func (b *CircuitBreaker) Call(f func() error) error {
+	if b == nil || b.Threshold <= 0 {
+		return f()
+	}
+
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	// Record the outcome even if f panics, so that a trial call is never left
+	// in progress, which would keep the circuit open for good
+	err := errors.Errorf("call did not complete")
+	defer func() { b.record(err) }()
+
+	err = f()
+	return err
+}
+
+func (b *CircuitBreaker) allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures < b.Threshold {
+		return nil
+	}
+
+	if b.trial || time.Since(b.openedAt) < b.Cooldown {
+		return ErrorCircuitOpen(fmt.Sprintf("circuit open after %d consecutive failures", b.failures))
+	}
+
+	b.trial = true
+	return nil
+}
+
+func (b *CircuitBreaker) record(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.Threshold {
+		b.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,241 @@
+package main_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+	"github.com/pkg/errors"
+)
+
+func TestRemoteRoles(t *testing.T) {
+	cases := map[string]struct {
+		failures    int // Number of failures before answering
+		failCode    int
+		retries     int
+		expected    []string
+		expectedErr bool
+		calls       int32
+	}{
+		"success": {
+			expected: []string{"admin", "submitter"},
+			calls:    1,
+		},
+		"retried": {
+			failures: 2,
+			failCode: http.StatusServiceUnavailable,
+			retries:  2,
+			expected: []string{"admin", "submitter"},
+			calls:    3,
+		},
+		"too many failures": {
+			failures:    3,
+			failCode:    http.StatusInternalServerError,
+			retries:     2,
+			expectedErr: true,
+			calls:       3,
+		},
+		"not retried": {
+			failures:    1,
+			failCode:    http.StatusBadRequest,
+			retries:     2,
+			expectedErr: true,
+			calls:       1,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			var calls int32
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				call := atomic.AddInt32(&calls, 1)
+
+				var user jhuda.User
+				if err := json.NewDecoder(r.Body).Decode(&user); err != nil || user.ID != "foo@example.org" {
+					t.Errorf("Did not receive expected user: %v", err)
+				}
+
+				if int(call) <= tc.failures {
+					w.WriteHeader(tc.failCode)
+					return
+				}
+
+				_, _ = w.Write([]byte(`["admin", "submitter"]`))
+			}))
+			defer server.Close()
+
+			roles, err := (&jhuda.RemoteRoles{
+				URL:      server.URL,
+				Retries:  tc.retries,
+				Backoff:  time.Millisecond,
+				RoleBase: "info:test/",
+			}).Lookup(&jhuda.User{ID: "foo@example.org"})
+
+			if calls := atomic.LoadInt32(&calls); calls != tc.calls {
+				t.Errorf("Expected %d calls, got %d", tc.calls, calls)
+			}
+
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatalf("Expected error, but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+
+			var names []string
+			for _, role := range roles {
+				names = append(names, role.Simple())
+			}
+
+			diffs := deep.Equal(names, tc.expected)
+			if len(diffs) > 0 {
+				t.Fatalf("Did not get expected roles:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+func TestRemoteRolesMalformedResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"roles": "admin"}`))
+	}))
+	defer server.Close()
+
+	_, err := (&jhuda.RemoteRoles{URL: server.URL}).Lookup(&jhuda.User{})
+	if err == nil {
+		t.Fatalf("Expected error!")
+	}
+}
+
+func TestRemoteRolesTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte(`["admin"]`))
+	}))
+	defer server.Close()
+
+	_, err := (&jhuda.RemoteRoles{
+		URL:     server.URL,
+		Timeout: 10 * time.Millisecond,
+	}).Lookup(&jhuda.User{})
+	if err == nil {
+		t.Fatalf("Expected timeout!")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls int
+	failing := func() error {
+		calls++
+		return errors.New("failed")
+	}
+	succeeding := func() error {
+		calls++
+		return nil
+	}
+
+	breaker := &jhuda.CircuitBreaker{
+		Threshold: 2,
+		Cooldown:  50 * time.Millisecond,
+	}
+
+	_ = breaker.Call(failing)
+	_ = breaker.Call(failing)
+
+	err := breaker.Call(succeeding)
+	if _, ok := errors.Cause(err).(jhuda.ErrorCircuitOpen); !ok {
+		t.Fatalf("Expected open circuit, got %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("Open circuit should not have made a call")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	// Failed trial call opens the circuit again
+	_ = breaker.Call(failing)
+	if err := breaker.Call(succeeding); err == nil {
+		t.Fatalf("Expected open circuit after failed trial")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	// Successful trial call closes the circuit
+	if err := breaker.Call(succeeding); err != nil {
+		t.Fatalf("Trial call should have succeeded: %v", err)
+	}
+	if err := breaker.Call(failing); err == nil || calls != 5 {
+		t.Fatalf("Closed circuit should have made a call")
+	}
+	if err := breaker.Call(succeeding); err != nil {
+		t.Fatalf("Circuit should not open below threshold: %v", err)
+	}
+}
+
+func TestCircuitBreakerPanic(t *testing.T) {
+	breaker := &jhuda.CircuitBreaker{
+		Threshold: 1,
+		Cooldown:  50 * time.Millisecond,
+	}
+
+	_ = breaker.Call(func() error { return errors.New("failed") })
+	time.Sleep(60 * time.Millisecond)
+
+	// A trial call that panics opens the circuit again, rather than staying in progress
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("Expected the panic to propagate")
+			}
+		}()
+		_ = breaker.Call(func() error { panic("boom") })
+	}()
+
+	if err := breaker.Call(func() error { return nil }); err == nil {
+		t.Fatalf("Expected open circuit after panicked trial")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if err := breaker.Call(func() error { return nil }); err != nil {
+		t.Fatalf("Trial call should have been let through and succeeded: %v", err)
+	}
+}
+
+func TestRemoteRolesCircuitBreaker(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	lookup := &jhuda.RemoteRoles{
+		URL:     server.URL,
+		Retries: 1,
+		Backoff: time.Millisecond,
+		Breaker: &jhuda.CircuitBreaker{Threshold: 1, Cooldown: time.Minute},
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := lookup.Lookup(&jhuda.User{}); err == nil {
+			t.Fatalf("Expected error!")
+		}
+	}
+
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Fatalf("Expected the circuit to open after one failed lookup, but got %d calls", calls)
+	}
+}
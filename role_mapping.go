@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RoleMapping assigns roles to users based on their eppn, the domain (scope)
+// of their eppn, any of their locator IDs, or their identity provider.  It is
+// typically loaded from a JSON file, for example:
+//
+//	{
+//	  "eppn":    {"admin@jhu.edu": ["admin"]},
+//	  "domain":  {"@jhu.edu": ["submitter"]},
+//	  "locator": {"johnshopkins.edu:Employeenumber:123": ["admin"]},
+//	  "idp":     {"urn:mace:incommon:johnshopkins.edu": ["reader"]}
+//	}
+type RoleMapping struct {
+	RoleBase string              `json:"-"`       // BaseURI for roles
+	Eppn     map[string][]string `json:"eppn"`    // Roles by exact eppn
+	Domain   map[string][]string `json:"domain"`  // Roles by eppn domain, with or without a leading @
+	Locator  map[string][]string `json:"locator"` // Roles by exact locator ID
+	IdP      map[string][]string `json:"idp"`     // Roles by identity provider entity ID
+}
+
+// LoadRoleMapping reads a JSON role mapping from the given file
+func LoadRoleMapping(path string) (*RoleMapping, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open role mapping file")
+	}
+	defer f.Close()
+
+	mapping, err := ReadRoleMapping(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read role mapping file %s", path)
+	}
+
+	return mapping, nil
+}
+
+// ReadRoleMapping decodes a JSON role mapping
+func ReadRoleMapping(r io.Reader) (*RoleMapping, error) {
+	var mapping RoleMapping
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&mapping); err != nil {
+		return nil, errors.Wrapf(err, "malformed role mapping")
+	}
+
+	// Domains are case insensitive, and may be written as @domain
+	domains := make(map[string][]string, len(mapping.Domain))
+	for domain, roles := range mapping.Domain {
+		domain = normalizeDomain(domain)
+		domains[domain] = append(domains[domain], roles...)
+	}
+	mapping.Domain = domains
+
+	return &mapping, nil
+}
+
+// Lookup finds all roles mapped to the user's eppn, eppn domain, locator IDs, or
+// identity provider
+func (m *RoleMapping) Lookup(u *User) ([]Role, error) {
+	if u == nil {
+		return nil, nil
+	}
+
+	var names []string
+
+	if u.Eppn != "" {
+		names = append(names, m.Eppn[u.Eppn]...)
+		if i := strings.LastIndex(u.Eppn, "@"); i >= 0 {
+			names = append(names, m.Domain[normalizeDomain(u.Eppn[i+1:])]...)
+		}
+	}
+
+	for _, locator := range u.Locatorids {
+		names = append(names, m.Locator[locator]...)
+	}
+
+	if u.IdentityProvider != "" {
+		names = append(names, m.IdP[u.IdentityProvider]...)
+	}
+
+	var roles []Role
+	for _, name := range names {
+		roles = append(roles, Role{
+			Base: m.RoleBase,
+			Name: name,
+		})
+	}
+
+	return roles, nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+}
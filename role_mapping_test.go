@@ -0,0 +1,101 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestRoleMapping(t *testing.T) {
+	mapping, err := jhuda.LoadRoleMapping("testdata/roles.json")
+	if err != nil {
+		t.Fatalf("Could not load role mapping: %v", err)
+	}
+	mapping.RoleBase = "info:test/"
+
+	cases := map[string]struct {
+		user     *jhuda.User
+		expected []string
+	}{
+		"eppn and domain": {
+			user: &jhuda.User{
+				Eppn: "admin@example.org",
+			},
+			expected: []string{"admin", "submitter"},
+		},
+		"domain is case insensitive": {
+			user: &jhuda.User{
+				Eppn: "foo@EXAMPLE.ORG",
+			},
+			expected: []string{"submitter"},
+		},
+		"locator": {
+			user: &jhuda.User{
+				Eppn:       "foo@elsewhere.org",
+				Locatorids: []string{"example.org:Eppn:foo@elsewhere.org", "example.org:Employeenumber:123"},
+			},
+			expected: []string{"reviewer"},
+		},
+		"identity provider": {
+			user: &jhuda.User{
+				Eppn:             "foo@elsewhere.org",
+				IdentityProvider: "https://idp.example.org/idp/shibboleth",
+			},
+			expected: []string{"reader"},
+		},
+		"no match": {
+			user: &jhuda.User{
+				Eppn: "foo@elsewhere.org",
+			},
+		},
+		"no user": {},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			roles, err := mapping.Lookup(tc.user)
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+
+			var names []string
+			for _, role := range roles {
+				if role.Base != "info:test/" {
+					t.Errorf("Wrong role base: %s", role.Base)
+				}
+				names = append(names, role.Simple())
+			}
+
+			diffs := deep.Equal(names, tc.expected)
+			if len(diffs) > 0 {
+				t.Fatalf("Did not get expected roles:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+func TestBadRoleMapping(t *testing.T) {
+	cases := map[string]string{
+		"malformed":     `{"eppn": `,
+		"unknown field": `{"eppns": {"foo@example.org": ["admin"]}}`,
+		"wrong type":    `{"eppn": {"foo@example.org": "admin"}}`,
+	}
+
+	for name, mapping := range cases {
+		mapping := mapping
+		t.Run(name, func(t *testing.T) {
+			_, err := jhuda.ReadRoleMapping(strings.NewReader(mapping))
+			if err == nil {
+				t.Fatalf("Expected error!")
+			}
+		})
+	}
+
+	_, err := jhuda.LoadRoleMapping("testdata/does-not-exist.json")
+	if err == nil {
+		t.Fatalf("Expected error for missing file")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// RoleRule grants roles to users for whom its expression is true, e.g.
+//
+//	{"name": "JHMI staff", "when": "email.endsWith('@jhmi.edu') && 'staff' in affiliation", "roles": ["submitter"]}
+//
+// Expressions may refer to the user's id, eppn, identityProvider, username,
+// email, displayName, firstName, middleName, lastName, and orcidId (strings), or
+// to affiliation, locatorIds, and groups (lists of strings).  See expr for the
+// syntax.
+type RoleRule struct {
+	Name  string   `json:"name"`  // Name of the rule, for explaining decisions
+	When  string   `json:"when"`  // Boolean expression over user fields
+	Roles []string `json:"roles"` // Roles granted when the expression is true
+
+	expr *expr
+}
+
+// RoleRules grants roles by evaluating rules over a user's fields
+type RoleRules struct {
+	RoleBase string     `json:"-"` // BaseURI for roles
+	Rules    []RoleRule `json:"rules"`
+}
+
+// LoadRoleRules reads JSON role rules from the given file
+func LoadRoleRules(path string) (*RoleRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open role rules file")
+	}
+	defer f.Close()
+
+	rules, err := ReadRoleRules(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read role rules file %s", path)
+	}
+
+	return rules, nil
+}
+
+// ReadRoleRules decodes and compiles JSON role rules
+func ReadRoleRules(r io.Reader) (*RoleRules, error) {
+	var rules RoleRules
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return nil, errors.Wrapf(err, "malformed role rules")
+	}
+
+	if err := rules.Compile(); err != nil {
+		return nil, err
+	}
+
+	return &rules, nil
+}
+
+// Compile parses each rule's expression.  Rules constructed in code must be
+// compiled before use.
+func (r *RoleRules) Compile() error {
+	types, err := typesOf(userEnv(&User{}))
+	if err != nil {
+		return err
+	}
+
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+
+		e, err := compileExpr(rule.When)
+		if err != nil {
+			return errors.Wrapf(err, "rule %d (%s)", i, rule.Name)
+		}
+		rule.expr = e
+
+		// Catch unknown names or type errors now, rather than for every user
+		if err := e.check(types); err != nil {
+			return errors.Wrapf(err, "rule %d (%s)", i, rule.Name)
+		}
+	}
+
+	return nil
+}
+
+// Lookup finds the roles granted by every rule that fires for the user
+func (r *RoleRules) Lookup(u *User) ([]Role, error) {
+	fired, err := r.Fired(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var roles []Role
+	for _, rule := range fired {
+		for _, name := range rule.Roles {
+			roles = append(roles, Role{
+				Base: r.RoleBase,
+				Name: name,
+			})
+		}
+	}
+
+	return roles, nil
+}
+
+// Fired evaluates the rules for the given user, and returns those that are true
+func (r *RoleRules) Fired(u *User) ([]RoleRule, error) {
+	if u == nil {
+		return nil, nil
+	}
+
+	env := userEnv(u)
+
+	var fired []RoleRule
+	for _, rule := range r.Rules {
+		ok, err := rule.fires(env)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			fired = append(fired, rule)
+		}
+	}
+
+	return fired, nil
+}
+
+func (rule RoleRule) fires(env exprEnv) (bool, error) {
+	if rule.expr == nil {
+		return false, errors.Errorf("rule %s has not been compiled", rule.Name)
+	}
+
+	ok, err := rule.expr.eval(env)
+	if err != nil {
+		return false, errors.Wrapf(err, "rule %s failed", rule.Name)
+	}
+
+	return ok, nil
+}
+
+// userEnv binds the names available to rule expressions
+func userEnv(u *User) exprEnv {
+	return exprEnv{
+		"id":               u.ID,
+		"eppn":             u.Eppn,
+		"identityProvider": u.IdentityProvider,
+		"username":         u.Username,
+		"email":            u.Email,
+		"displayName":      u.Displayname,
+		"firstName":        u.Firstname,
+		"middleName":       u.Middlename,
+		"lastName":         u.Lastname,
+		"orcidId":          u.OrcidID,
+		"affiliation":      nonNil(u.Affiliation),
+		"locatorIds":       nonNil(u.Locatorids),
+		"groups":           nonNil(u.Groups),
+	}
+}
+
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
@@ -0,0 +1,129 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestRoleRules(t *testing.T) {
+	rules, err := jhuda.LoadRoleRules("testdata/role-rules.json")
+	if err != nil {
+		t.Fatalf("Could not load role rules: %v", err)
+	}
+
+	cases := map[string]struct {
+		user     *jhuda.User
+		fired    []string
+		expected []string
+	}{
+		"staff": {
+			user: &jhuda.User{
+				Email:       "bo@jhmi.edu",
+				Affiliation: []string{"staff"},
+			},
+			fired:    []string{"JHMI staff"},
+			expected: []string{"submitter"},
+		},
+		"several rules": {
+			user: &jhuda.User{
+				Eppn:       "admin@example.org",
+				Locatorids: []string{"example.org:Employeenumber:123"},
+			},
+			fired:    []string{"Employees", "Admins"},
+			expected: []string{"submitter", "reviewer", "admin"},
+		},
+		"identity provider": {
+			user: &jhuda.User{
+				Eppn:             "foo@partner.org",
+				IdentityProvider: "https://idp.partner.org/idp/shibboleth",
+			},
+			fired:    []string{"Partner IdP"},
+			expected: []string{"reader"},
+		},
+		"no rules": {
+			user: &jhuda.User{
+				Email:       "bo@jhmi.edu",
+				Affiliation: []string{"student"},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			fired, err := rules.Fired(tc.user)
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+
+			var firedNames []string
+			for _, rule := range fired {
+				firedNames = append(firedNames, rule.Name)
+			}
+
+			if diffs := deep.Equal(firedNames, tc.fired); len(diffs) > 0 {
+				t.Fatalf("Did not fire expected rules:\n%s", strings.Join(diffs, "\n"))
+			}
+
+			roles, err := rules.Lookup(tc.user)
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+
+			var names []string
+			for _, role := range roles {
+				names = append(names, role.Simple())
+			}
+
+			if diffs := deep.Equal(names, tc.expected); len(diffs) > 0 {
+				t.Fatalf("Did not get expected roles:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+func TestBadRoleRules(t *testing.T) {
+	cases := map[string]string{
+		"malformed":    `{"rules": [`,
+		"syntax error": `{"rules": [{"name": "bad", "when": "email ==", "roles": ["admin"]}]}`,
+		"unknown name": `{"rules": [{"name": "bad", "when": "mail == 'a'", "roles": ["admin"]}]}`,
+		"not boolean":  `{"rules": [{"name": "bad", "when": "email", "roles": ["admin"]}]}`,
+		"type error":   `{"rules": [{"name": "bad", "when": "affiliation == 'staff'", "roles": ["admin"]}]}`,
+
+		// Evaluation would short-circuit before the errors, for users without an email
+		"unknown name after &&":   `{"rules": [{"name": "bad", "when": "email != '' && mial == 'a'", "roles": ["admin"]}]}`,
+		"type error after ||":     `{"rules": [{"name": "bad", "when": "email == '' || 'a' in email", "roles": ["admin"]}]}`,
+		"unknown name in exists":  `{"rules": [{"name": "bad", "when": "affiliation.exists(a, a == afiliation)", "roles": ["admin"]}]}`,
+		"type error in predicate": `{"rules": [{"name": "bad", "when": "groups.all(g, g.exists(x, true))", "roles": ["admin"]}]}`,
+	}
+
+	for name, rules := range cases {
+		rules := rules
+		t.Run(name, func(t *testing.T) {
+			if _, err := jhuda.ReadRoleRules(strings.NewReader(rules)); err == nil {
+				t.Fatalf("Expected error!")
+			}
+		})
+	}
+}
+
+func TestUncompiledRoleRules(t *testing.T) {
+	rules := &jhuda.RoleRules{
+		Rules: []jhuda.RoleRule{{Name: "uncompiled", When: "true", Roles: []string{"admin"}}},
+	}
+
+	if _, err := rules.Lookup(&jhuda.User{}); err == nil {
+		t.Fatalf("Expected error!")
+	}
+
+	if err := rules.Compile(); err != nil {
+		t.Fatalf("Could not compile: %v", err)
+	}
+
+	if roles, err := rules.Lookup(&jhuda.User{}); err != nil || len(roles) != 1 {
+		t.Fatalf("Expected compiled rule to fire: %v %v", roles, err)
+	}
+}
@@ -2,33 +2,63 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 )
 
 func serve() *cli.Command {
 
 	var us UserService
-	var port int
+	var rc roleConfig
+	var sc serveConfig
+	var ic idConfig
+	var pc proxyConfig
+	var tc tokenConfig
+	var hs signatureConfig
+	var pathRulesFile string
+	var claimsFile string
 
 	return &cli.Command{
 		Name:  "serve",
 		Usage: "Start the user service web service",
-		Flags: []cli.Flag{
+		Flags: append(userFlags(&us, &ic),
 			&cli.IntFlag{
 				Name:        "port",
 				Usage:       "Port for serving http user service",
 				Required:    false,
-				Destination: &port,
+				Destination: &sc.Port,
 				EnvVars:     []string{"USER_SERVICE_PORT"},
 				Value:       8091,
 			},
+			&cli.StringFlag{
+				Name:     "listen",
+				Usage:    "comma-separated list of addresses serving every endpoint, e.g. :8091 or unix:/run/user-service.sock.  Default :port",
+				Required: false,
+				EnvVars:  []string{"USER_SERVICE_LISTEN"},
+			},
+			&cli.StringFlag{
+				Name:     "publicListen",
+				Usage:    "comma-separated list of addresses serving only /whoami",
+				Required: false,
+				EnvVars:  []string{"USER_SERVICE_PUBLIC_LISTEN"},
+			},
+			&cli.StringFlag{
+				Name:     "socketMode",
+				Usage:    "Permissions of unix sockets, in octal",
+				Required: false,
+				EnvVars:  []string{"USER_SERVICE_SOCKET_MODE"},
+				Value:    "0660",
+			},
 			&cli.StringFlag{
 				Name:        "context",
 				Usage:       "JSON-LD context URI",
@@ -37,46 +67,42 @@ func serve() *cli.Command {
 				EnvVars:     []string{"USER_SERVICE_JSONLD_CONTEXT"},
 			},
 			&cli.StringFlag{
-				Name:        "eppnHeader",
+				Name:        "forwardAuthRulesFile",
+				Usage:       "JSON file with the roles required for each path, for the /forwardauth endpoint",
 				Required:    false,
-				Destination: &us.HeaderDefs.Eppn,
-				EnvVars:     []string{"SHIB_HEADER_EPPN"},
-				Value:       DefaultShibHeaders.Eppn,
+				Destination: &pathRulesFile,
+				EnvVars:     []string{"USER_SERVICE_FORWARD_AUTH_RULES_FILE"},
 			},
 			&cli.StringFlag{
-				Name:        "displayNameHeader",
+				Name:        "forwardAuthMethodHeader",
+				Usage:       "Header in which the proxy gives /forwardauth the original request method, which it must overwrite",
 				Required:    false,
-				Destination: &us.HeaderDefs.Displayname,
-				EnvVars:     []string{"SHIB_HEADER_DISPLAYNAME"},
-				Value:       DefaultShibHeaders.Displayname,
+				Destination: &sc.Forwarded.MethodHeader,
+				EnvVars:     []string{"USER_SERVICE_FORWARD_AUTH_METHOD_HEADER"},
+				Value:       DefaultForwardedMethodHeader,
 			},
 			&cli.StringFlag{
-				Name:        "emailHeader",
+				Name:        "forwardAuthUriHeader",
+				Usage:       "Header in which the proxy gives /forwardauth the original request URI, which it must overwrite",
 				Required:    false,
-				Destination: &us.HeaderDefs.Email,
-				EnvVars:     []string{"SHIB_HEADER_EMAIL"},
-				Value:       DefaultShibHeaders.Email,
+				Destination: &sc.Forwarded.URIHeader,
+				EnvVars:     []string{"USER_SERVICE_FORWARD_AUTH_URI_HEADER"},
+				Value:       DefaultForwardedURIHeader,
 			},
 			&cli.StringFlag{
-				Name:        "givenNameHeader",
+				Name:        "userinfoClaimsFile",
+				Usage:       "JSON file mapping /userinfo claims to user properties",
 				Required:    false,
-				Destination: &us.HeaderDefs.GivenName,
-				EnvVars:     []string{"SHIB_HEADER_GIVEN_NAME"},
-				Value:       DefaultShibHeaders.GivenName,
+				Destination: &claimsFile,
+				EnvVars:     []string{"USER_SERVICE_USERINFO_CLAIMS_FILE"},
 			},
 			&cli.StringFlag{
-				Name:        "lastNameHeader",
+				Name:        "extAuthzPrefix",
+				Usage:       "Path prefix of the Envoy HTTP ext_authz endpoint (empty to disable)",
 				Required:    false,
-				Destination: &us.HeaderDefs.LastName,
-				EnvVars:     []string{"SHIB_HEADER_LAST_NAME"},
-				Value:       DefaultShibHeaders.LastName,
-			},
-			&cli.StringFlag{
-				Name:     "locatorHeaders",
-				Usage:    "comma-separated list of headers to use as locators",
-				Required: false,
-				EnvVars:  []string{"SHIB_HEADERS_LOCATOR"},
-				Value:    strings.Join(DefaultShibHeaders.LocatorIDs, ","),
+				Destination: &sc.ExtAuthzPrefix,
+				EnvVars:     []string{"USER_SERVICE_EXT_AUTHZ_PREFIX"},
+				Value:       "/extauthz",
 			},
 			&cli.StringFlag{
 				Name:        "userBaseUrl",
@@ -85,39 +111,1084 @@ func serve() *cli.Command {
 				Destination: &us.UserBase,
 				EnvVars:     []string{"USER_SERVICE_USER_BASEURL"},
 			},
-		},
+			&cli.StringFlag{
+				Name:     "tlsCert",
+				Usage:    "PEM certificate (chain) file, for serving TLS",
+				Required: false,
+				EnvVars:  []string{"USER_SERVICE_TLS_CERT"},
+			},
+			&cli.StringFlag{
+				Name:     "tlsKey",
+				Usage:    "PEM private key file, for serving TLS",
+				Required: false,
+				EnvVars:  []string{"USER_SERVICE_TLS_KEY"},
+			},
+			&cli.StringFlag{
+				Name:     "tlsClientCA",
+				Usage:    "PEM CA certificates file verifying client certificates, for mutual TLS",
+				Required: false,
+				EnvVars:  []string{"USER_SERVICE_TLS_CLIENT_CA"},
+			},
+			&cli.BoolFlag{
+				Name:     "tlsRequireClientCert",
+				Usage:    "Require a client certificate, rather than only verifying any given",
+				Required: false,
+				EnvVars:  []string{"USER_SERVICE_TLS_REQUIRE_CLIENT_CERT"},
+			},
+			&cli.DurationFlag{
+				Name:        "tlsReloadInterval",
+				Usage:       "Interval between checks for changed TLS files, never if 0.  Files are also reloaded on SIGHUP",
+				Required:    false,
+				Destination: &sc.TLSReload,
+				EnvVars:     []string{"USER_SERVICE_TLS_RELOAD_INTERVAL"},
+				Value:       time.Minute,
+			},
+			&cli.StringFlag{
+				Name:     "trustedProxies",
+				Usage:    "comma-separated list of networks (CIDR) or addresses that requests must come from, any if empty",
+				Required: false,
+				EnvVars:  []string{"USER_SERVICE_TRUSTED_PROXIES"},
+			},
+			&cli.StringFlag{
+				Name:        "trustedProxySecret",
+				Usage:       "Shared secret that the proxy must send",
+				Required:    false,
+				Destination: &pc.Secret,
+				EnvVars:     []string{"USER_SERVICE_TRUSTED_PROXY_SECRET"},
+			},
+			&cli.StringFlag{
+				Name:        "trustedProxySecretHeader",
+				Usage:       "Header carrying the proxy's shared secret",
+				Required:    false,
+				Destination: &pc.SecretHeader,
+				EnvVars:     []string{"USER_SERVICE_TRUSTED_PROXY_SECRET_HEADER"},
+				Value:       DefaultProxySecretHeader,
+			},
+			&cli.BoolFlag{
+				Name:        "trustedProxyClientCert",
+				Usage:       "Require a verified TLS client certificate from the proxy",
+				Required:    false,
+				Destination: &pc.ClientCert,
+				EnvVars:     []string{"USER_SERVICE_TRUSTED_PROXY_CLIENT_CERT"},
+			},
+			&cli.StringFlag{
+				Name:     "trustedProxyClientNames",
+				Usage:    "comma-separated list of client certificate names (subject CN or DNS name) trusted, any if empty",
+				Required: false,
+				EnvVars:  []string{"USER_SERVICE_TRUSTED_PROXY_CLIENT_NAMES"},
+			},
+			&cli.StringFlag{
+				Name:     "headerSignatureKeys",
+				Usage:    "comma-separated list of id=secret keys, any of which may sign identity headers.  Signatures are not required if empty",
+				Required: false,
+				EnvVars:  []string{"USER_SERVICE_HEADER_SIGNATURE_KEYS"},
+			},
+			&cli.StringFlag{
+				Name:        "headerSignatureHeader",
+				Usage:       "Header carrying the signature of the identity headers",
+				Required:    false,
+				Destination: &hs.Header,
+				EnvVars:     []string{"USER_SERVICE_HEADER_SIGNATURE_HEADER"},
+				Value:       DefaultSignatureHeader,
+			},
+			&cli.DurationFlag{
+				Name:        "headerSignatureMaxAge",
+				Usage:       "Maximum age of identity header signatures",
+				Required:    false,
+				Destination: &hs.MaxAge,
+				EnvVars:     []string{"USER_SERVICE_HEADER_SIGNATURE_MAX_AGE"},
+				Value:       DefaultSignatureMaxAge,
+			},
+			&cli.StringFlag{
+				Name:        "tokenKeyFile",
+				Usage:       "PEM private key (RSA, EC, or Ed25519) signing identity tokens, which are not issued if empty",
+				Required:    false,
+				Destination: &tc.KeyFile,
+				EnvVars:     []string{"USER_SERVICE_TOKEN_KEY_FILE"},
+			},
+			&cli.StringFlag{
+				Name:        "tokenKeyId",
+				Usage:       "Key ID (kid) of the token signing key",
+				Required:    false,
+				Destination: &tc.KeyID,
+				EnvVars:     []string{"USER_SERVICE_TOKEN_KEY_ID"},
+			},
+			&cli.StringFlag{
+				Name:        "tokenIssuer",
+				Usage:       "Issuer (iss) of identity tokens",
+				Required:    false,
+				Destination: &tc.Issuer,
+				EnvVars:     []string{"USER_SERVICE_TOKEN_ISSUER"},
+			},
+			&cli.StringFlag{
+				Name:     "tokenAudience",
+				Usage:    "comma-separated list of audiences (aud) of identity tokens",
+				Required: false,
+				EnvVars:  []string{"USER_SERVICE_TOKEN_AUDIENCE"},
+			},
+			&cli.DurationFlag{
+				Name:        "tokenLifetime",
+				Usage:       "Lifetime of identity tokens",
+				Required:    false,
+				Destination: &tc.Lifetime,
+				EnvVars:     []string{"USER_SERVICE_TOKEN_LIFETIME"},
+				Value:       DefaultTokenLifetime,
+			},
+			&cli.BoolFlag{
+				Name:        "whoamiToken",
+				Usage:       "Give an identity token in the " + TokenHeader + " header of /whoami responses",
+				Required:    false,
+				Destination: &sc.WhoamiToken,
+				EnvVars:     []string{"USER_SERVICE_WHOAMI_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:        "roleBaseUrl",
+				Usage:       "BaseURL for roles",
+				Required:    false,
+				Destination: &rc.RoleBase,
+				EnvVars:     []string{"USER_SERVICE_ROLE_BASEURL"},
+			},
+			&cli.StringFlag{
+				Name:     "defaultRoles",
+				Usage:    "comma-separated list of roles given to every user",
+				Required: false,
+				EnvVars:  []string{"USER_SERVICE_DEFAULT_ROLES"},
+			},
+			&cli.StringFlag{
+				Name:        "roleMappingFile",
+				Usage:       "JSON file mapping eppns, domains, or locator IDs to roles",
+				Required:    false,
+				Destination: &rc.MappingFile,
+				EnvVars:     []string{"USER_SERVICE_ROLE_MAPPING_FILE"},
+			},
+			&cli.StringFlag{
+				Name:        "groupRoleFile",
+				Usage:       "JSON file with rules mapping groups or entitlements to roles",
+				Required:    false,
+				Destination: &rc.GroupFile,
+				EnvVars:     []string{"USER_SERVICE_GROUP_ROLE_FILE"},
+			},
+			&cli.StringFlag{
+				Name:        "roleRulesFile",
+				Usage:       "JSON file with rules granting roles based on user attributes",
+				Required:    false,
+				Destination: &rc.RulesFile,
+				EnvVars:     []string{"USER_SERVICE_ROLE_RULES_FILE"},
+			},
+			&cli.StringFlag{
+				Name:     "optionalRoleSources",
+				Usage:    "comma-separated list of role sources (default, mapping, groups, rules, ldap, remote) whose failures are logged and skipped",
+				Required: false,
+				EnvVars:  []string{"USER_SERVICE_OPTIONAL_ROLE_SOURCES"},
+			},
+			&cli.StringFlag{
+				Name:        "ldapUrl",
+				Usage:       "URL of an LDAP server to search for group membership, e.g. ldaps://ldap.example.org",
+				Required:    false,
+				Destination: &rc.Ldap.URL,
+				EnvVars:     []string{"USER_SERVICE_LDAP_URL"},
+			},
+			&cli.StringFlag{
+				Name:        "ldapBindDn",
+				Usage:       "DN to bind to LDAP as (anonymous if not given)",
+				Required:    false,
+				Destination: &rc.Ldap.BindDN,
+				EnvVars:     []string{"USER_SERVICE_LDAP_BIND_DN"},
+			},
+			&cli.StringFlag{
+				Name:        "ldapBindPassword",
+				Usage:       "Password for the LDAP bind DN",
+				Required:    false,
+				Destination: &rc.Ldap.BindPassword,
+				EnvVars:     []string{"USER_SERVICE_LDAP_BIND_PASSWORD"},
+			},
+			&cli.StringFlag{
+				Name:        "ldapBaseDn",
+				Usage:       "Base DN for LDAP searches",
+				Required:    false,
+				Destination: &rc.Ldap.BaseDN,
+				EnvVars:     []string{"USER_SERVICE_LDAP_BASE_DN"},
+			},
+			&cli.StringFlag{
+				Name:        "ldapFilter",
+				Usage:       "LDAP search filter, with {eppn}, {uid}, {domain}, or {locator:<header>} placeholders",
+				Required:    false,
+				Destination: &rc.Ldap.Filter,
+				EnvVars:     []string{"USER_SERVICE_LDAP_FILTER"},
+				Value:       "(eduPersonPrincipalName={eppn})",
+			},
+			&cli.StringFlag{
+				Name:        "ldapGroupAttribute",
+				Usage:       "Attribute of LDAP entries listing their groups",
+				Required:    false,
+				Destination: &rc.Ldap.GroupAttribute,
+				EnvVars:     []string{"USER_SERVICE_LDAP_GROUP_ATTRIBUTE"},
+				Value:       DefaultLdapGroupAttribute,
+			},
+			&cli.DurationFlag{
+				Name:        "ldapTimeout",
+				Usage:       "Timeout for connecting to and searching LDAP",
+				Required:    false,
+				Destination: &rc.Ldap.Timeout,
+				EnvVars:     []string{"USER_SERVICE_LDAP_TIMEOUT"},
+				Value:       DefaultLdapTimeout,
+			},
+			&cli.StringFlag{
+				Name:        "ldapGroupRoleFile",
+				Usage:       "JSON file with rules mapping LDAP groups to roles (by default, each group is a role)",
+				Required:    false,
+				Destination: &rc.LdapGroupFile,
+				EnvVars:     []string{"USER_SERVICE_LDAP_GROUP_ROLE_FILE"},
+			},
+			&cli.StringFlag{
+				Name:        "remoteRolesUrl",
+				Usage:       "URL of a remote service to POST users to for their roles",
+				Required:    false,
+				Destination: &rc.Remote.URL,
+				EnvVars:     []string{"USER_SERVICE_REMOTE_ROLES_URL"},
+			},
+			&cli.DurationFlag{
+				Name:        "remoteRolesTimeout",
+				Usage:       "Timeout for each request to the remote role service",
+				Required:    false,
+				Destination: &rc.Remote.Timeout,
+				EnvVars:     []string{"USER_SERVICE_REMOTE_ROLES_TIMEOUT"},
+				Value:       DefaultRemoteTimeout,
+			},
+			&cli.IntFlag{
+				Name:        "remoteRolesRetries",
+				Usage:       "Number of times to retry failed requests to the remote role service",
+				Required:    false,
+				Destination: &rc.Remote.Retries,
+				EnvVars:     []string{"USER_SERVICE_REMOTE_ROLES_RETRIES"},
+				Value:       2,
+			},
+			&cli.DurationFlag{
+				Name:        "remoteRolesBackoff",
+				Usage:       "Delay before the first retry of the remote role service, doubled for each subsequent retry",
+				Required:    false,
+				Destination: &rc.Remote.Backoff,
+				EnvVars:     []string{"USER_SERVICE_REMOTE_ROLES_BACKOFF"},
+				Value:       100 * time.Millisecond,
+			},
+			&cli.IntFlag{
+				Name:        "remoteRolesBreakerThreshold",
+				Usage:       "Consecutive failed lookups before the remote role service is no longer called (0 to disable)",
+				Required:    false,
+				Destination: &rc.BreakerThreshold,
+				EnvVars:     []string{"USER_SERVICE_REMOTE_ROLES_BREAKER_THRESHOLD"},
+				Value:       5,
+			},
+			&cli.DurationFlag{
+				Name:        "remoteRolesBreakerCooldown",
+				Usage:       "Time to wait before calling the remote role service again after too many failures",
+				Required:    false,
+				Destination: &rc.BreakerCooldown,
+				EnvVars:     []string{"USER_SERVICE_REMOTE_ROLES_BREAKER_COOLDOWN"},
+				Value:       30 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:        "roleCacheTtl",
+				Usage:       "How long to cache roles from LDAP or the remote role service (0 to disable)",
+				Required:    false,
+				Destination: &rc.Cache.TTL,
+				EnvVars:     []string{"USER_SERVICE_ROLE_CACHE_TTL"},
+			},
+			&cli.DurationFlag{
+				Name:        "roleCacheNegativeTtl",
+				Usage:       "How long to cache failed role lookups, or stale roles served because of them",
+				Required:    false,
+				Destination: &rc.Cache.NegativeTTL,
+				EnvVars:     []string{"USER_SERVICE_ROLE_CACHE_NEGATIVE_TTL"},
+			},
+			&cli.IntFlag{
+				Name:        "roleCacheSize",
+				Usage:       "Maximum number of users whose roles are cached",
+				Required:    false,
+				Destination: &rc.Cache.MaxSize,
+				EnvVars:     []string{"USER_SERVICE_ROLE_CACHE_SIZE"},
+				Value:       10000,
+			},
+			&cli.BoolFlag{
+				Name:        "roleCacheServeStale",
+				Usage:       "Serve expired cached roles when a role lookup fails",
+				Required:    false,
+				Destination: &rc.Cache.ServeStale,
+				EnvVars:     []string{"USER_SERVICE_ROLE_CACHE_SERVE_STALE"},
+			},
+		),
 		Action: func(c *cli.Context) error {
-			us.HeaderDefs.LocatorIDs = strings.Split(c.String("locatorHeaders"), ",")
+			if err := applyUserFlags(c, &us, ic); err != nil {
+				return err
+			}
+			pc.Networks = splitList(c.String("trustedProxies"))
+			pc.ClientNames = splitList(c.String("trustedProxyClientNames"))
+			rc.DefaultRoles = splitList(c.String("defaultRoles"))
+			rc.Optional = splitList(c.String("optionalRoleSources"))
+
+			roles, err := rc.lookup()
+			if err != nil {
+				return err
+			}
+			us.Roles = roles
+
+			sc.Listen = splitList(c.String("listen"))
+			sc.PublicListen = splitList(c.String("publicListen"))
+			if sc.SocketMode, err = parseSocketMode(c.String("socketMode")); err != nil {
+				return err
+			}
+
+			if sc.TLS, err = tlsFiles(c); err != nil {
+				return err
+			}
+
+			if sc.Proxy, err = pc.proxy(); err != nil {
+				return err
+			}
+
+			hs.Keys = splitList(c.String("headerSignatureKeys"))
+			if sc.Signature, err = hs.signature(us); err != nil {
+				return err
+			}
+
+			tc.Audience = splitList(c.String("tokenAudience"))
+			if sc.Tokens, err = tc.issuer(); err != nil {
+				return err
+			}
 
-			return serveAction(us, port)
+			if pathRulesFile != "" {
+				if sc.PathRules, err = LoadPathRules(pathRulesFile); err != nil {
+					return err
+				}
+			}
+
+			if claimsFile != "" {
+				if sc.Claims, err = LoadClaimMapping(claimsFile); err != nil {
+					return err
+				}
+			}
+
+			return serveAction(us, sc)
 		},
 	}
 }
 
-func serveAction(us UserService, port int) error {
+// tlsFiles gives the TLS files configured by flags, or nil if TLS is not configured
+func tlsFiles(c *cli.Context) (*TLSFiles, error) {
+	files := &TLSFiles{
+		CertFile:          c.String("tlsCert"),
+		KeyFile:           c.String("tlsKey"),
+		ClientCAFile:      c.String("tlsClientCA"),
+		RequireClientCert: c.Bool("tlsRequireClientCert"),
+	}
+
+	switch {
+	case files.CertFile == "" && files.KeyFile == "" && files.ClientCAFile == "":
+		return nil, nil
+	case files.CertFile == "" || files.KeyFile == "":
+		return nil, errors.Errorf("TLS needs both a certificate and key")
+	case files.RequireClientCert && files.ClientCAFile == "":
+		return nil, errors.Errorf("requiring client certificates needs a client CA")
+	}
+
+	return files, nil
+}
+
+// proxyConfig describes the trusted proxy
+type proxyConfig struct {
+	Networks     []string
+	Secret       string
+	SecretHeader string
+	ClientCert   bool
+	ClientNames  []string
+}
+
+// proxy creates the trusted proxy, or nil if there are no checks configured
+func (pc proxyConfig) proxy() (*TrustedProxy, error) {
+	if len(pc.Networks) == 0 && pc.Secret == "" && !pc.ClientCert {
+		return nil, nil
+	}
+
+	networks, err := ParseNetworks(pc.Networks)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad trusted proxies")
+	}
+
+	return &TrustedProxy{
+		Networks:     networks,
+		SecretHeader: pc.SecretHeader,
+		Secret:       pc.Secret,
+		ClientCert:   pc.ClientCert,
+		ClientNames:  pc.ClientNames,
+	}, nil
+}
+
+// signatureConfig describes the signing of identity headers
+type signatureConfig struct {
+	Keys   []string
+	Header string
+	MaxAge time.Duration
+}
+
+// signature creates the signature verifying the user service's identity
+// headers, or nil if there are no keys configured
+func (hc signatureConfig) signature(us UserService) (*HeaderSignature, error) {
+	if len(hc.Keys) == 0 {
+		return nil, nil
+	}
+
+	keys, err := ParseSignatureKeys(hc.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HeaderSignature{
+		Header:  hc.Header,
+		Keys:    keys,
+		Headers: us.IdentityHeaders(),
+		MaxAge:  hc.MaxAge,
+	}, nil
+}
+
+// tokenConfig describes the issuing of identity tokens
+type tokenConfig struct {
+	KeyFile  string
+	KeyID    string
+	Issuer   string
+	Audience []string
+	Lifetime time.Duration
+}
+
+// issuer creates the token issuer, or nil if no signing key is configured
+func (tc tokenConfig) issuer() (*TokenIssuer, error) {
+	if tc.KeyFile == "" {
+		return nil, nil
+	}
+
+	key, err := LoadSigningKey(tc.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenIssuer{
+		Key:      key,
+		KeyID:    tc.KeyID,
+		Issuer:   tc.Issuer,
+		Audience: tc.Audience,
+		Lifetime: tc.Lifetime,
+	}, nil
+}
+
+// idConfig describes the scheme for user IDs
+type idConfig struct {
+	Scheme    string
+	Salt      string
+	Namespace string
+	Header    string
+}
+
+// scheme creates the configured ID scheme
+func (ic idConfig) scheme(values ValueParser) (IDScheme, error) {
+	switch ic.Scheme {
+	case "", "eppn":
+		return EppnID{}, nil
+	case "escaped":
+		return EscapedEppnID{}, nil
+	case "hash":
+		if ic.Salt == "" {
+			return nil, errors.Errorf("hashed user IDs need a salt, as unsalted hashes of eppns are easily reversed")
+		}
+		return HashedEppnID{Salt: ic.Salt}, nil
+	case "uuid":
+		namespace, err := ParseUUID(ic.Namespace)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad ID namespace")
+		}
+		return UUIDEppnID{Namespace: namespace}, nil
+	case "locator":
+		if ic.Header == "" {
+			return nil, errors.Errorf("locator user IDs need an ID header")
+		}
+		return LocatorHeaderID{Header: ic.Header, Values: values}, nil
+	default:
+		return nil, errors.Errorf("unknown ID scheme '%s'", ic.Scheme)
+	}
+}
+
+// roleConfig describes the role sources configured for serve
+type roleConfig struct {
+	RoleBase         string
+	DefaultRoles     []string
+	MappingFile      string
+	GroupFile        string
+	RulesFile        string
+	Ldap             LdapRoles
+	LdapGroupFile    string
+	Remote           RemoteRoles
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	Cache            roleCacheConfig // Caching of the LDAP and remote sources
+	Optional         []string        // Names of sources whose errors are skipped
+}
+
+// roleCacheConfig describes how expensive role sources are cached
+type roleCacheConfig struct {
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	MaxSize     int
+	ServeStale  bool
+}
+
+// wrap caches the given lookup, if caching is enabled
+func (cc roleCacheConfig) wrap(lookup RoleLookup) RoleLookup {
+	if cc.TTL <= 0 {
+		return lookup
+	}
+
+	return &CachedRoles{
+		Roles:       lookup,
+		TTL:         cc.TTL,
+		NegativeTTL: cc.NegativeTTL,
+		MaxSize:     cc.MaxSize,
+		ServeStale:  cc.ServeStale,
+	}
+}
+
+// roleSourceNames are the names of the role sources that may be configured
+var roleSourceNames = []string{"default", "mapping", "groups", "rules", "ldap", "remote"}
+
+// lookup builds a composite lookup from all configured role sources
+func (rc roleConfig) lookup() (RoleLookup, error) {
+	for _, optional := range rc.Optional {
+		known := false
+		for _, name := range roleSourceNames {
+			known = known || name == optional
+		}
+		if !known {
+			return nil, errors.Errorf("unknown optional role source '%s', expected one of %s",
+				optional, strings.Join(roleSourceNames, ", "))
+		}
+	}
+
+	roles := CompositeRoleLookup{}
+	add := func(name string, lookup RoleLookup, upstream bool) {
+		policy := FailOnError
+		for _, optional := range rc.Optional {
+			if optional == name {
+				policy = SkipOnError
+			}
+		}
+		roles.Sources = append(roles.Sources, RoleSource{
+			Name:     name,
+			Roles:    lookup,
+			OnError:  policy,
+			Upstream: upstream,
+		})
+	}
+
+	add("default", RoleService{
+		RoleBase:     rc.RoleBase,
+		DefaultRoles: rc.DefaultRoles,
+	}, false)
+
+	if rc.MappingFile != "" {
+		mapping, err := LoadRoleMapping(rc.MappingFile)
+		if err != nil {
+			return nil, err
+		}
+		mapping.RoleBase = rc.RoleBase
+		add("mapping", mapping, false)
+	}
+
+	if rc.GroupFile != "" {
+		groupRoles, err := LoadGroupRoles(rc.GroupFile)
+		if err != nil {
+			return nil, err
+		}
+		groupRoles.RoleBase = rc.RoleBase
+		add("groups", groupRoles, false)
+	}
+
+	if rc.RulesFile != "" {
+		rules, err := LoadRoleRules(rc.RulesFile)
+		if err != nil {
+			return nil, err
+		}
+		rules.RoleBase = rc.RoleBase
+		add("rules", rules, false)
+	}
+
+	if rc.Ldap.URL != "" {
+		ldapRoles := rc.Ldap
+		ldapRoles.RoleBase = rc.RoleBase
+
+		if rc.LdapGroupFile != "" {
+			groupRoles, err := LoadGroupRoles(rc.LdapGroupFile)
+			if err != nil {
+				return nil, err
+			}
+			groupRoles.RoleBase = rc.RoleBase
+			ldapRoles.Mapping = groupRoles
+		}
+		add("ldap", rc.Cache.wrap(&ldapRoles), true)
+	}
+
+	if rc.Remote.URL != "" {
+		remoteRoles := rc.Remote
+		remoteRoles.RoleBase = rc.RoleBase
+		remoteRoles.Breaker = &CircuitBreaker{
+			Threshold: rc.BreakerThreshold,
+			Cooldown:  rc.BreakerCooldown,
+		}
+		add("remote", rc.Cache.wrap(&remoteRoles), true)
+	}
+
+	return roles, nil
+}
+
+// serveConfig describes how and what to serve
+type serveConfig struct {
+	Port           int
+	PathRules      *PathRules       // Roles required by path, for forward auth and ext_authz
+	Forwarded      ForwardedRequest // Headers giving the original request to forward auth
+	ExtAuthzPrefix string           // Path prefix of the ext_authz endpoint, disabled if empty
+	Proxy          *TrustedProxy    // Proxy requests must come from, any if nil
+	TLS            *TLSFiles        // Serve TLS with these files, plain HTTP if nil
+	TLSReload      time.Duration    // Interval between checks for changed TLS files, never if zero
+	Listen         []string         // Addresses serving every endpoint, :Port if neither these nor PublicListen are given
+	PublicListen   []string         // Addresses serving only /whoami
+	SocketMode     os.FileMode      // Permissions of unix sockets
+	Signature      *HeaderSignature // Signature identity headers must have, not required if nil
+	Claims         *ClaimMapping    // Claims given by /userinfo, DefaultClaims if nil
+	Tokens         *TokenIssuer     // Issues identity tokens from /token, disabled if nil
+	WhoamiToken    bool             // Give an identity token in /whoami responses
+}
+
+func serveAction(us UserService, sc serveConfig) error {
 	stop := make(chan os.Signal, 1)
 	done := make(chan error, 1)
+	reload := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+
+	var whoamiTokens *TokenIssuer
+	if sc.WhoamiToken {
+		if sc.Tokens == nil {
+			return errors.Errorf("identity tokens on /whoami need a token signing key, which is not configured")
+		}
+		whoamiTokens = sc.Tokens
+	}
+
+	// Only endpoints that read identity headers need them from a trusted proxy,
+	// and signed; /jwks is for downstream services, which send neither
+	signed := func(handler http.Handler) http.Handler {
+		return sc.Proxy.Wrap(sc.Signature.Wrap(handler))
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/whoami", httpUserService(us))
+	mux.Handle("/whoami", signed(httpUserService(us, whoamiTokens)))
+	mux.Handle("/userinfo", signed(httpUserInfoService(us, sc.Claims)))
+	mux.Handle("/authz", signed(httpAuthzService(us)))
+	mux.Handle("/forwardauth", signed(httpForwardAuthService(us, sc.PathRules, sc.Forwarded)))
+
+	if prefix := strings.TrimSuffix(sc.ExtAuthzPrefix, "/"); prefix != "" {
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, signed(httpExtAuthzService(us, sc.PathRules))))
+	}
+
+	if sc.Tokens != nil {
+		mux.Handle("/token", signed(httpTokenService(us, sc.Tokens)))
+		mux.Handle("/jwks", httpJWKSService(sc.Tokens))
+	}
+
+	public := http.NewServeMux()
+	public.Handle("/whoami", signed(httpUserService(us, whoamiTokens)))
+
+	if sc.Proxy != nil && sc.Proxy.ClientCert && (sc.TLS == nil || sc.TLS.ClientCAFile == "") {
+		return errors.Errorf("trusted proxy client certificates need TLS with a client CA, which is not configured")
+	}
+
+	if sc.TLS != nil {
+		if err := sc.TLS.Load(); err != nil {
+			return err
+		}
 
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: mux,
+		signal.Notify(reload, syscall.SIGHUP)
+		defer signal.Stop(reload)
+
+		if sc.TLSReload > 0 {
+			stopWatching := make(chan struct{})
+			defer close(stopWatching)
+			go sc.TLS.Watch(sc.TLSReload, stopWatching)
+		}
+	}
+
+	addresses := sc.Listen
+	if len(addresses) == 0 && len(sc.PublicListen) == 0 {
+		addresses = []string{fmt.Sprintf(":%d", sc.Port)}
+	}
+
+	var servers []*http.Server
+	shutdown := func() {
+		for _, server := range servers {
+			_ = server.Shutdown(context.Background())
+		}
 	}
 
-	go func() {
-		log.Printf("Listening on port %d", port)
-		done <- server.ListenAndServe()
-	}()
+	serve := func(address string, handler http.Handler) error {
+		l, err := listen(address, sc.SocketMode)
+		if err != nil {
+			return err
+		}
+
+		server := &http.Server{Handler: handler}
+		servers = append(servers, server)
+
+		// TLS is pointless over a unix socket, whose permissions restrict access
+		if sc.TLS != nil && !strings.HasPrefix(address, UnixPrefix) {
+			server.TLSConfig = sc.TLS.Config()
+			l = tls.NewListener(l, server.TLSConfig)
+		}
+
+		go func() {
+			log.Printf("Listening on %s", address)
+			if err := server.Serve(l); err != http.ErrServerClosed {
+				select {
+				case done <- err:
+				default:
+				}
+			}
+		}()
 
-	select {
-	case <-stop:
-		_ = server.Shutdown(context.Background())
-		log.Printf("Goodbye!")
 		return nil
-	case err := <-done:
+	}
+
+	for _, address := range addresses {
+		if err := serve(address, mux); err != nil {
+			shutdown()
+			return err
+		}
+	}
+	for _, address := range sc.PublicListen {
+		if err := serve(address, public); err != nil {
+			shutdown()
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-reload:
+			sc.TLS.reload("signalled")
+		case <-stop:
+			shutdown()
+			log.Printf("Goodbye!")
+			return nil
+		case err := <-done:
+			shutdown()
+			return err
+		}
+	}
+}
+
+// userFlags defines the flags shaping users resolved from headers: the header
+// names, user ID scheme, value parsing, and which identities and affiliations
+// are allowed.  They must be applied with applyUserFlags.
+func userFlags(us *UserService, ic *idConfig) []cli.Flag {
+	return append(append(headerFlags(&us.HeaderDefs), idFlags(ic)...),
+		&cli.StringFlag{
+			Name:        "multiValueDelimiter",
+			Usage:       "Delimiter between the values of multi-valued headers",
+			Required:    false,
+			Destination: &us.Values.Delimiter,
+			EnvVars:     []string{"SHIB_MULTI_VALUE_DELIMITER"},
+			Value:       DefaultValueParser.Delimiter,
+		},
+		&cli.StringFlag{
+			Name:        "multiValueEscape",
+			Usage:       "Escape preceding a literal delimiter within a value of a multi-valued header",
+			Required:    false,
+			Destination: &us.Values.Escape,
+			EnvVars:     []string{"SHIB_MULTI_VALUE_ESCAPE"},
+			Value:       DefaultValueParser.Escape,
+		},
+		&cli.IntFlag{
+			Name:        "maxHeaderLength",
+			Usage:       "Maximum length of header values",
+			Required:    false,
+			Destination: &us.MaxHeaderLength,
+			EnvVars:     []string{"USER_SERVICE_MAX_HEADER_LENGTH"},
+			Value:       DefaultMaxHeaderLength,
+		},
+		&cli.StringFlag{
+			Name:     "allowedDomains",
+			Usage:    "comma-separated list of eppn domains (scopes) allowed, all if empty",
+			Required: false,
+			EnvVars:  []string{"USER_SERVICE_ALLOWED_DOMAINS"},
+		},
+		&cli.StringFlag{
+			Name:     "deniedDomains",
+			Usage:    "comma-separated list of eppn domains (scopes) denied",
+			Required: false,
+			EnvVars:  []string{"USER_SERVICE_DENIED_DOMAINS"},
+		},
+		&cli.StringFlag{
+			Name:     "allowedIdps",
+			Usage:    "comma-separated list of identity provider entity IDs allowed, all if empty",
+			Required: false,
+			EnvVars:  []string{"USER_SERVICE_ALLOWED_IDPS"},
+		},
+		&cli.StringFlag{
+			Name:     "deniedIdps",
+			Usage:    "comma-separated list of identity provider entity IDs denied",
+			Required: false,
+			EnvVars:  []string{"USER_SERVICE_DENIED_IDPS"},
+		},
+		&cli.BoolFlag{
+			Name:        "usernameFromEppn",
+			Usage:       "Use the local part of the eppn as username, when there is no username header",
+			Required:    false,
+			Destination: &us.EppnUsername,
+			EnvVars:     []string{"USER_SERVICE_USERNAME_FROM_EPPN"},
+		},
+		&cli.BoolFlag{
+			Name:        "stripAffiliationScope",
+			Usage:       "Remove the scope from affiliations, e.g. staff@jhu.edu becomes staff",
+			Required:    false,
+			Destination: &us.Affiliation.StripScope,
+			EnvVars:     []string{"USER_SERVICE_STRIP_AFFILIATION_SCOPE"},
+		},
+		&cli.StringFlag{
+			Name:     "allowedAffiliations",
+			Usage:    "comma-separated list of affiliations to keep, e.g. " + strings.Join(EduPersonAffiliations, ","),
+			Required: false,
+			EnvVars:  []string{"USER_SERVICE_ALLOWED_AFFILIATIONS"},
+		},
+	)
+}
+
+// applyUserFlags applies the header flags and lists given by userFlags, and
+// sets the user ID scheme
+func applyUserFlags(c *cli.Context, us *UserService, ic idConfig) error {
+	if err := applyHeaderFlags(c, us); err != nil {
 		return err
 	}
+	us.Affiliation.Allowed = splitList(c.String("allowedAffiliations"))
+	us.Identity.AllowedDomains = splitList(c.String("allowedDomains"))
+	us.Identity.DeniedDomains = splitList(c.String("deniedDomains"))
+	us.Identity.AllowedIdPs = splitList(c.String("allowedIdps"))
+	us.Identity.DeniedIdPs = splitList(c.String("deniedIdps"))
+
+	ids, err := ic.scheme(us.Values)
+	if err != nil {
+		return err
+	}
+	us.IDs = ids
+
+	return nil
+}
+
+// idFlags defines flags for the scheme of user IDs
+func idFlags(ic *idConfig) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "idScheme",
+			Usage:       "Scheme for user IDs: eppn, escaped, hash, uuid, or locator",
+			Required:    false,
+			Destination: &ic.Scheme,
+			EnvVars:     []string{"USER_SERVICE_ID_SCHEME"},
+			Value:       "eppn",
+		},
+		&cli.StringFlag{
+			Name:        "idHashSalt",
+			Usage:       "Secret salt for hashed user IDs, required for the hash scheme",
+			Required:    false,
+			Destination: &ic.Salt,
+			EnvVars:     []string{"USER_SERVICE_ID_HASH_SALT"},
+		},
+		&cli.StringFlag{
+			Name:        "idNamespace",
+			Usage:       "Namespace UUID for uuid user IDs",
+			Required:    false,
+			Destination: &ic.Namespace,
+			EnvVars:     []string{"USER_SERVICE_ID_NAMESPACE"},
+			Value:       formatUUID(URLNamespace),
+		},
+		&cli.StringFlag{
+			Name:        "idHeader",
+			Usage:       "Header identifying users, for locator user IDs",
+			Required:    false,
+			Destination: &ic.Header,
+			EnvVars:     []string{"USER_SERVICE_ID_HEADER"},
+			Value:       "unique-id",
+		},
+	}
+}
+
+// headerFlags defines flags for the names of Shibboleth headers.  Those that
+// are lists, the locator format, and the attribute mapping file, must be applied
+// with applyHeaderFlags.
+func headerFlags(defs *ShibHeaders) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "eppnHeader",
+			Required:    false,
+			Destination: &defs.Eppn,
+			EnvVars:     []string{"SHIB_HEADER_EPPN"},
+			Value:       DefaultShibHeaders.Eppn,
+		},
+		&cli.StringFlag{
+			Name:        "displayNameHeader",
+			Required:    false,
+			Destination: &defs.Displayname,
+			EnvVars:     []string{"SHIB_HEADER_DISPLAYNAME"},
+			Value:       DefaultShibHeaders.Displayname,
+		},
+		&cli.StringFlag{
+			Name:        "emailHeader",
+			Required:    false,
+			Destination: &defs.Email,
+			EnvVars:     []string{"SHIB_HEADER_EMAIL"},
+			Value:       DefaultShibHeaders.Email,
+		},
+		&cli.StringFlag{
+			Name:        "givenNameHeader",
+			Required:    false,
+			Destination: &defs.GivenName,
+			EnvVars:     []string{"SHIB_HEADER_GIVEN_NAME"},
+			Value:       DefaultShibHeaders.GivenName,
+		},
+		&cli.StringFlag{
+			Name:        "lastNameHeader",
+			Required:    false,
+			Destination: &defs.LastName,
+			EnvVars:     []string{"SHIB_HEADER_LAST_NAME"},
+			Value:       DefaultShibHeaders.LastName,
+		},
+		&cli.StringFlag{
+			Name:        "middleNameHeader",
+			Required:    false,
+			Destination: &defs.Middlename,
+			EnvVars:     []string{"SHIB_HEADER_MIDDLE_NAME"},
+			Value:       DefaultShibHeaders.Middlename,
+		},
+		&cli.StringFlag{
+			Name:        "usernameHeader",
+			Required:    false,
+			Destination: &defs.Username,
+			EnvVars:     []string{"SHIB_HEADER_USERNAME"},
+			Value:       DefaultShibHeaders.Username,
+		},
+		&cli.StringFlag{
+			Name:        "orcidHeader",
+			Usage:       "header containing the ORCID iD, bare or as a URI",
+			Required:    false,
+			Destination: &defs.OrcidID,
+			EnvVars:     []string{"SHIB_HEADER_ORCID"},
+			Value:       DefaultShibHeaders.OrcidID,
+		},
+		&cli.StringFlag{
+			Name:        "identityProviderHeader",
+			Usage:       "header containing the entity ID of the user's identity provider",
+			Required:    false,
+			Destination: &defs.IdentityProvider,
+			EnvVars:     []string{"SHIB_HEADER_IDENTITY_PROVIDER"},
+			Value:       DefaultShibHeaders.IdentityProvider,
+		},
+		&cli.StringFlag{
+			Name:     "locatorHeaders",
+			Usage:    "comma-separated list of headers to use as locators",
+			Required: false,
+			EnvVars:  []string{"SHIB_HEADERS_LOCATOR"},
+			Value:    strings.Join(DefaultShibHeaders.LocatorIDs, ","),
+		},
+		&cli.StringFlag{
+			Name:     "affiliationHeaders",
+			Usage:    "comma-separated list of multi-valued affiliation headers, the first with any values is used",
+			Required: false,
+			EnvVars:  []string{"SHIB_HEADERS_AFFILIATION"},
+			Value:    strings.Join(DefaultShibHeaders.Affiliation, ","),
+		},
+		&cli.StringFlag{
+			Name:     "locatorTemplate",
+			Usage:    "template for locator IDs, with {domain}, {name}, and {value} placeholders",
+			Required: false,
+			EnvVars:  []string{"SHIB_LOCATOR_TEMPLATE"},
+			Value:    DefaultLocatorTemplate,
+		},
+		&cli.StringFlag{
+			Name:     "scopedLocatorHeaders",
+			Usage:    "comma-separated list of locator headers with scoped values, e.g. 123@jhu.edu, whose scope is used as the domain",
+			Required: false,
+			EnvVars:  []string{"SHIB_HEADERS_SCOPED_LOCATOR"},
+		},
+		&cli.StringFlag{
+			Name:     "locatorAliases",
+			Usage:    "comma-separated list of header=name, naming locator headers in locator IDs, e.g. Employeenumber=employeeid",
+			Required: false,
+			EnvVars:  []string{"SHIB_LOCATOR_ALIASES"},
+		},
+		&cli.StringFlag{
+			Name:     "attributeMappingFile",
+			Usage:    "JSON file mapping user properties to headers, replacing the header flags for the properties it maps",
+			Required: false,
+			EnvVars:  []string{"USER_SERVICE_ATTRIBUTE_MAPPING_FILE"},
+		},
+		&cli.StringFlag{
+			Name:     "groupHeaders",
+			Usage:    "comma-separated list of multi-valued group or entitlement headers",
+			Required: false,
+			EnvVars:  []string{"SHIB_HEADERS_GROUP"},
+			Value:    strings.Join(DefaultShibHeaders.Groups, ","),
+		},
+	}
+}
+
+// applyHeaderFlags sets the header definitions given as lists and the locator
+// format, and loads any attribute mapping file
+func applyHeaderFlags(c *cli.Context, us *UserService) error {
+	defs := &us.HeaderDefs
+	defs.LocatorIDs = strings.Split(c.String("locatorHeaders"), ",")
+	defs.Groups = splitList(c.String("groupHeaders"))
+	if defs.Groups == nil {
+		defs.Groups = []string{}
+	}
+	defs.Affiliation = splitList(c.String("affiliationHeaders"))
+	if defs.Affiliation == nil {
+		defs.Affiliation = []string{}
+	}
+
+	us.Locators.Template = c.String("locatorTemplate")
+	us.Locators.Scoped = splitList(c.String("scopedLocatorHeaders"))
+	for _, alias := range splitList(c.String("locatorAliases")) {
+		parts := strings.SplitN(alias, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return errors.Errorf("locator aliases are expected to be header=name, instead got '%s'", alias)
+		}
+		if us.Locators.Aliases == nil {
+			us.Locators.Aliases = map[string]string{}
+		}
+		us.Locators.Aliases[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	if file := c.String("attributeMappingFile"); file != "" {
+		mappings, err := LoadAttributeMappings(file)
+		if err != nil {
+			return err
+		}
+		us.Attributes = mappings
+	}
+
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(list string) []string {
+	var vals []string
+	for _, val := range strings.Split(list, ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			vals = append(vals, val)
+		}
+	}
+
+	return vals
 }
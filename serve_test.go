@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -19,6 +26,7 @@ func TestServe(t *testing.T) {
 	cases := map[string]struct {
 		args     []string
 		headers  map[string]string
+		signKeys map[string][]byte // Keys signing the headers, with the key "signer"
 		expected User
 	}{
 		"defaults": {
@@ -77,6 +85,79 @@ func TestServe(t *testing.T) {
 				Locatorids: []string{"example.org:Eppn:foo@example.org"},
 			},
 		},
+		"default roles": {
+			args: []string{"-roleBaseUrl", "http://example.org/roles#", "-defaultRoles", "submitter, admin,"},
+			headers: map[string]string{
+				DefaultShibHeaders.Eppn: "foo@example.org",
+			},
+			expected: User{
+				ID:         "foo@example.org",
+				Type:       "User",
+				Locatorids: []string{"example.org:Eppn:foo@example.org"},
+				Roles:      []string{"submitter", "admin"},
+			},
+		},
+		"role mapping file": {
+			args: []string{"-defaultRoles", "reader", "-roleMappingFile", "testdata/roles.json"},
+			headers: map[string]string{
+				DefaultShibHeaders.Eppn: "admin@example.org",
+			},
+			expected: User{
+				ID:         "admin@example.org",
+				Type:       "User",
+				Locatorids: []string{"example.org:Eppn:admin@example.org"},
+				Roles:      []string{"reader", "admin", "submitter"},
+			},
+		},
+		"group roles": {
+			args: []string{"-groupHeaders", "Test-Groups", "-groupRoleFile", "testdata/group-roles.json"},
+			headers: map[string]string{
+				DefaultShibHeaders.Eppn: "foo@example.org",
+				"Test-Groups":           "urn:mace:example.org:groups:admins;urn:mace:example.org:groups:dept:library",
+			},
+			expected: User{
+				ID:         "foo@example.org",
+				Type:       "User",
+				Locatorids: []string{"example.org:Eppn:foo@example.org"},
+				Roles:      []string{"admin", "library-member"},
+			},
+		},
+		"role rules": {
+			args: []string{"-roleRulesFile", "testdata/role-rules.json"},
+			headers: map[string]string{
+				DefaultShibHeaders.Eppn: "admin@example.org",
+			},
+			expected: User{
+				ID:         "admin@example.org",
+				Type:       "User",
+				Locatorids: []string{"example.org:Eppn:admin@example.org"},
+				Roles:      []string{"admin"},
+			},
+		},
+		"trusted proxy": {
+			args: []string{"-trustedProxies", "127.0.0.0/8,::1", "-trustedProxySecret", "s3cret"},
+			headers: map[string]string{
+				DefaultShibHeaders.Eppn:  "foo@example.org",
+				DefaultProxySecretHeader: "s3cret",
+			},
+			expected: User{
+				ID:         "foo@example.org",
+				Type:       "User",
+				Locatorids: []string{"example.org:Eppn:foo@example.org"},
+			},
+		},
+		"signed headers": {
+			args: []string{"-headerSignatureKeys", "old=s3cret,signer=n3wer"},
+			headers: map[string]string{
+				DefaultShibHeaders.Eppn: "foo@example.org",
+			},
+			signKeys: map[string][]byte{"signer": []byte("n3wer")},
+			expected: User{
+				ID:         "foo@example.org",
+				Type:       "User",
+				Locatorids: []string{"example.org:Eppn:foo@example.org"},
+			},
+		},
 	}
 
 	for name, tc := range cases {
@@ -91,6 +172,14 @@ func TestServe(t *testing.T) {
 			for k, v := range tc.headers {
 				req.Header.Add(k, v)
 			}
+			if tc.signKeys != nil {
+				signature := &HeaderSignature{Keys: tc.signKeys, Headers: UserService{}.IdentityHeaders()}
+				value, err := signature.Sign(req.Header, "signer", time.Now())
+				if err != nil {
+					t.Fatalf("Could not sign headers: %v", err)
+				}
+				req.Header.Set(DefaultSignatureHeader, value)
+			}
 
 			resp := attempt(t, req)
 			defer resp.Body.Close()
@@ -112,14 +201,172 @@ func TestServe(t *testing.T) {
 			// Basically, send our server a ^C and let it stop itself gracefully
 			proc, _ := os.FindProcess(os.Getpid())
 			_ = proc.Signal(os.Interrupt)
+			awaitShutdown(t, port)
 		})
 	}
 }
 
+func TestServeListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listeners")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "user-service.sock")
+	port := strconv.Itoa(randomPort(t))
+
+	go run([]string{os.Args[0], "serve",
+		"-listen", "unix:" + socket,
+		"-publicListen", "localhost:" + port,
+		"-socketMode", "0600",
+		"-trustedProxies", "10.0.0.0/8,127.0.0.0/8,::1",
+	})
+
+	get := func(client *http.Client, url string) int {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set(DefaultShibHeaders.Eppn, "foo@example.org")
+		client.Timeout = 10 * time.Second
+		resp := attemptWith(t, client, req)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	overSocket := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	for url, expected := range map[string]int{
+		"http://localhost:" + port + "/whoami": http.StatusOK,
+		"http://localhost:" + port + "/authz":  http.StatusNotFound,
+	} {
+		if code := get(&http.Client{}, url); code != expected {
+			t.Errorf("Got code %d from public %s, but expected %d", code, url, expected)
+		}
+	}
+
+	for _, path := range []string{"/whoami", "/authz"} {
+		if code := get(overSocket, "http://socket"+path); code != http.StatusOK {
+			t.Errorf("Got code %d from socket %s, but expected %d", code, path, http.StatusOK)
+		}
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("Could not stat socket: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Socket has mode %o, but expected 0600", info.Mode().Perm())
+	}
+
+	proc, _ := os.FindProcess(os.Getpid())
+	_ = proc.Signal(os.Interrupt)
+	awaitShutdown(t, port)
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(socket); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Socket %s was not removed on shutdown", socket)
+}
+
+func TestServeSignedEndpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signed")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+
+	// Downstream services verifying tokens neither have signed headers to send,
+	// nor are trusted proxies
+	for name, flags := range map[string][]string{
+		"signed headers": {"-headerSignatureKeys", "k=s3cret"},
+		"trusted proxy":  {"-trustedProxySecret", "s3cret"},
+	} {
+		port := strconv.Itoa(randomPort(t))
+		go run(append([]string{os.Args[0], "serve", "-port", port, "-tokenKeyFile", keyFile}, flags...))
+
+		for path, expected := range map[string]int{
+			"/jwks":        http.StatusOK,
+			"/whoami":      http.StatusForbidden,
+			"/token":       http.StatusForbidden,
+			"/userinfo":    http.StatusForbidden,
+			"/authz":       http.StatusForbidden,
+			"/forwardauth": http.StatusForbidden,
+			"/extauthz/":   http.StatusForbidden,
+		} {
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost:"+port+path, nil)
+			req.Header.Set(DefaultShibHeaders.Eppn, "foo@example.org")
+			resp := attempt(t, req)
+			resp.Body.Close()
+			if resp.StatusCode != expected {
+				t.Errorf("Got code %d from %s with %s, but expected %d", resp.StatusCode, path, name, expected)
+			}
+		}
+
+		proc, _ := os.FindProcess(os.Getpid())
+		_ = proc.Signal(os.Interrupt)
+		awaitShutdown(t, port)
+	}
+}
+
+func TestOptionalRoleSources(t *testing.T) {
+	lookup, err := roleConfig{Optional: []string{"default", "ldap"}}.lookup()
+	if err != nil {
+		t.Fatalf("Known role sources should be accepted: %v", err)
+	}
+	if policy := lookup.(CompositeRoleLookup).Sources[0].OnError; policy != SkipOnError {
+		t.Fatalf("Optional default source should be skipped on error, got policy %d", policy)
+	}
+
+	if _, err := (roleConfig{Optional: []string{"ldpa"}}).lookup(); err == nil {
+		t.Fatalf("Expected an error for an unknown role source")
+	}
+}
+
+func TestHashIDConfig(t *testing.T) {
+	if _, err := (idConfig{Scheme: "hash"}).scheme(ValueParser{}); err == nil {
+		t.Fatalf("Expected an error for the hash scheme without a salt")
+	}
+
+	if _, err := (idConfig{Scheme: "hash", Salt: "s3cret"}).scheme(ValueParser{}); err != nil {
+		t.Fatalf("Could not create the hash scheme: %v", err)
+	}
+}
+
+// awaitShutdown waits until nothing is listening on the given port, so that
+// a pending interrupt cannot be delivered to the next test's server
+func awaitShutdown(t *testing.T, port string) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", "localhost:"+port)
+		if err != nil {
+			return
+		}
+		conn.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("User service on port %s did not shut down", port)
+}
+
 func attempt(t *testing.T, req *http.Request) *http.Response {
+	return attemptWith(t, &http.Client{}, req)
+}
+
+func attemptWith(t *testing.T, client *http.Client, req *http.Request) *http.Response {
 	var err error
 	var resp *http.Response
-	client := &http.Client{}
 	for i := 0; i < 100; i++ {
 		resp, err = client.Do(req)
 		if err == nil {
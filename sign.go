@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+func sign() *cli.Command {
+
+	var us UserService
+	var ic idConfig
+	var hs signatureConfig
+	var keyID string
+
+	return &cli.Command{
+		Name:      "sign",
+		Usage:     "Sign a sample set of identity headers, as the front-end proxy would, for testing",
+		ArgsUsage: "[header: value]...",
+		Flags: append(userFlags(&us, &ic),
+			&cli.StringFlag{
+				Name:     "headerSignatureKeys",
+				Usage:    "comma-separated list of id=secret keys",
+				Required: true,
+				EnvVars:  []string{"USER_SERVICE_HEADER_SIGNATURE_KEYS"},
+			},
+			&cli.StringFlag{
+				Name:        "headerSignatureHeader",
+				Usage:       "Header carrying the signature of the identity headers",
+				Required:    false,
+				Destination: &hs.Header,
+				EnvVars:     []string{"USER_SERVICE_HEADER_SIGNATURE_HEADER"},
+				Value:       DefaultSignatureHeader,
+			},
+			&cli.StringFlag{
+				Name:        "keyId",
+				Usage:       "ID of the key to sign with, the first key if empty",
+				Required:    false,
+				Destination: &keyID,
+			},
+		),
+		Action: func(c *cli.Context) error {
+			if err := applyUserFlags(c, &us, ic); err != nil {
+				return err
+			}
+
+			hs.Keys = splitList(c.String("headerSignatureKeys"))
+			signature, err := hs.signature(us)
+			if err != nil {
+				return err
+			}
+			if signature == nil {
+				return errors.Errorf("no signature keys given")
+			}
+			if keyID == "" {
+				keyID = strings.SplitN(hs.Keys[0], "=", 2)[0]
+			}
+
+			headers, err := parseHeaderArgs(c.Args().Slice())
+			if err != nil {
+				return err
+			}
+
+			value, err := signature.Sign(headers, keyID, time.Now())
+			if err != nil {
+				return err
+			}
+
+			_, err = fmt.Fprintf(c.App.Writer, "%s: %s\n", oneOf(hs.Header, DefaultSignatureHeader), value)
+			return err
+		},
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TLSFiles serves TLS with a certificate, key, and (for mutual TLS) client CA
+// certificates read from files.  The files may be reloaded while serving, so
+// that rotating certificates needs no restart.
+type TLSFiles struct {
+	CertFile          string // PEM certificate chain
+	KeyFile           string // PEM private key
+	ClientCAFile      string // PEM CA certificates that verify client certificates, none if empty
+	RequireClientCert bool   // Require clients to present a certificate, rather than just verifying any given
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modified  map[string]time.Time
+}
+
+// Load reads the files.  If they cannot be read, the previously loaded
+// certificates are kept.
+func (f *TLSFiles) Load() error {
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return errors.Wrapf(err, "could not load TLS certificate")
+	}
+
+	var clientCAs *x509.CertPool
+	if f.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(f.ClientCAFile)
+		if err != nil {
+			return errors.Wrapf(err, "could not read client CA file")
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.Errorf("no certificates in client CA file %s", f.ClientCAFile)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cert = &cert
+	f.clientCAs = clientCAs
+	f.modified = f.modTimes()
+
+	return nil
+}
+
+// tlsNextProtos are the protocols offered in ALPN, so that HTTP/2 is negotiated
+// where clients support it
+var tlsNextProtos = []string{"h2", "http/1.1"}
+
+// Config gives a TLS server config using the most recently loaded files
+func (f *TLSFiles) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: tlsNextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			f.mu.RLock()
+			defer f.mu.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*f.cert},
+				NextProtos:   tlsNextProtos,
+			}
+
+			if f.clientCAs != nil {
+				config.ClientCAs = f.clientCAs
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				if f.RequireClientCert {
+					config.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+
+			return config, nil
+		},
+	}
+}
+
+// Watch reloads the files whenever they change, checking at the given
+// interval until stopped
+func (f *TLSFiles) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if f.changed() {
+				f.reload("changed")
+			}
+		}
+	}
+}
+
+// reload loads the files, logging the outcome
+func (f *TLSFiles) reload(why string) {
+	if err := f.Load(); err != nil {
+		log.Printf("TLS files %s, but could not reload them: %v", why, err)
+
+		// Wait for the next change, rather than retrying the same files
+		f.mu.Lock()
+		f.modified = f.modTimes()
+		f.mu.Unlock()
+		return
+	}
+
+	log.Printf("TLS files %s, reloaded", why)
+}
+
+func (f *TLSFiles) changed() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for file, modified := range f.modTimes() {
+		if !modified.Equal(f.modified[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *TLSFiles) modTimes() map[string]time.Time {
+	modified := map[string]time.Time{}
+	for _, file := range []string{f.CertFile, f.KeyFile, f.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			modified[file] = info.ModTime()
+		}
+	}
+
+	return modified
+}
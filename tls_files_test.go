@@ -0,0 +1,283 @@
+package main_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+// testCert is a certificate and key, signed by a parent or self-signed
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, serial int64, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		DNSNames:              []string{cn},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key as PEM files
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("Could not write certificate: %v", err)
+	}
+
+	if keyFile == "" {
+		return
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	return dir
+}
+
+func servedSerial(t *testing.T, files *jhuda.TLSFiles) int64 {
+	config, err := files.Config().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("Could not get config: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("Could not parse served certificate: %v", err)
+	}
+
+	return cert.SerialNumber.Int64()
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	files := &jhuda.TLSFiles{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	}
+
+	ca := newTestCert(t, "ca", 1, nil, x509.ExtKeyUsageServerAuth)
+	newTestCert(t, "localhost", 2, ca, x509.ExtKeyUsageServerAuth).write(t, files.CertFile, files.KeyFile)
+
+	if err := files.Load(); err != nil {
+		t.Fatalf("Could not load TLS files: %v", err)
+	}
+	if serial := servedSerial(t, files); serial != 2 {
+		t.Fatalf("Served certificate %d, but expected 2", serial)
+	}
+
+	// A failed reload keeps the old certificate
+	if err := ioutil.WriteFile(files.KeyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+	if err := files.Load(); err == nil {
+		t.Fatalf("Expected an error loading a bad key")
+	}
+	if serial := servedSerial(t, files); serial != 2 {
+		t.Fatalf("Served certificate %d, but expected 2", serial)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go files.Watch(10*time.Millisecond, stop)
+
+	newTestCert(t, "localhost", 3, ca, x509.ExtKeyUsageServerAuth).write(t, files.CertFile, files.KeyFile)
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{files.CertFile, files.KeyFile} {
+		_ = os.Chtimes(file, later, later)
+	}
+
+	for i := 0; i < 100; i++ {
+		if servedSerial(t, files) == 3 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Changed certificate was not reloaded")
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	files := &jhuda.TLSFiles{
+		CertFile:          filepath.Join(dir, "cert.pem"),
+		KeyFile:           filepath.Join(dir, "key.pem"),
+		ClientCAFile:      filepath.Join(dir, "ca.pem"),
+		RequireClientCert: true,
+	}
+
+	serverCA := newTestCert(t, "server-ca", 1, nil, x509.ExtKeyUsageServerAuth)
+	newTestCert(t, "localhost", 2, serverCA, x509.ExtKeyUsageServerAuth).write(t, files.CertFile, files.KeyFile)
+
+	clientCA := newTestCert(t, "client-ca", 3, nil, x509.ExtKeyUsageClientAuth)
+	clientCA.write(t, files.ClientCAFile, "")
+	client := newTestCert(t, "sp.example.org", 4, clientCA, x509.ExtKeyUsageClientAuth)
+	stranger := newTestCert(t, "sp.example.org", 5, newTestCert(t, "other-ca", 6, nil, x509.ExtKeyUsageClientAuth), x509.ExtKeyUsageClientAuth)
+
+	if err := files.Load(); err != nil {
+		t.Fatalf("Could not load TLS files: %v", err)
+	}
+
+	proxy := &jhuda.TrustedProxy{ClientCert: true, ClientNames: []string{"sp.example.org"}}
+	server := httptest.NewUnstartedServer(proxy.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	server.TLS = files.Config()
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+
+	cases := map[string]struct {
+		certs []tls.Certificate
+		ok    bool
+	}{
+		"client certificate": {
+			certs: []tls.Certificate{client.tlsCert()},
+			ok:    true,
+		},
+		"no client certificate": {},
+		"untrusted client certificate": {
+			certs: []tls.Certificate{stranger.tlsCert()},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:      roots,
+				Certificates: tc.certs,
+			}}}
+
+			resp, err := c.Get(server.URL)
+			if !tc.ok {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("Expected TLS handshake to fail, got %d", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Got code %d, but expected %d", resp.StatusCode, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	files := &jhuda.TLSFiles{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	}
+
+	ca := newTestCert(t, "ca", 1, nil, x509.ExtKeyUsageServerAuth)
+	newTestCert(t, "localhost", 2, ca, x509.ExtKeyUsageServerAuth).write(t, files.CertFile, files.KeyFile)
+
+	if err := files.Load(); err != nil {
+		t.Fatalf("Could not load TLS files: %v", err)
+	}
+
+	// Serve as serveAction does, with a TLS listener rather than ListenAndServeTLS
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+
+	server := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		TLSConfig: files.Config(),
+	}
+	go func() { _ = server.Serve(tls.NewListener(l, server.TLSConfig)) }()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	c := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+
+	resp, err := c.Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Expected HTTP/2, got %s", resp.Proto)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultTokenLifetime is how long identity tokens are valid, by default
+const DefaultTokenLifetime = 5 * time.Minute
+
+// TokenIssuer issues JWTs (signed JWS, compact form) asserting a user's
+// identity and roles, so that downstream services may verify them rather than
+// trust forwarded headers.  The algorithm follows from the key: RS256 for RSA,
+// ES256, ES384, or ES512 for EC P-256, P-384 or P-521, and EdDSA for Ed25519.
+type TokenIssuer struct {
+	Key      crypto.Signer // Private key signing tokens
+	KeyID    string        // Key ID (kid) given in token headers and the JWK set, optional
+	Issuer   string        // Issuer (iss) claim
+	Audience []string      // Audience (aud) claim, omitted if empty
+	Lifetime time.Duration // Tokens expire after this, DefaultTokenLifetime if zero
+}
+
+// TokenClaims are the claims of an identity token
+type TokenClaims struct {
+	Issuer            string      `json:"iss,omitempty"`
+	Subject           string      `json:"sub"`
+	Audience          interface{} `json:"aud,omitempty"` // A string, or list of strings
+	IssuedAt          int64       `json:"iat"`
+	NotBefore         int64       `json:"nbf"`
+	Expires           int64       `json:"exp"`
+	ID                string      `json:"jti"`
+	Eppn              string      `json:"eppn,omitempty"`
+	Name              string      `json:"name,omitempty"`
+	GivenName         string      `json:"given_name,omitempty"`
+	FamilyName        string      `json:"family_name,omitempty"`
+	PreferredUsername string      `json:"preferred_username,omitempty"`
+	Email             string      `json:"email,omitempty"`
+	Orcid             string      `json:"orcid,omitempty"`
+	Affiliation       []string    `json:"affiliation,omitempty"`
+	Roles             []string    `json:"roles,omitempty"`
+}
+
+// LoadSigningKey reads a PEM private key (PKCS#8, PKCS#1 RSA, or SEC 1 EC)
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read signing key")
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("no PEM data in signing key file %s", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse signing key %s", path)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("signing key %s cannot sign", path)
+	}
+
+	if _, err := algorithm(signer); err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+// Issue issues a token for the user
+func (i *TokenIssuer) Issue(u *User) (string, error) {
+	alg, err := algorithm(i.Key)
+	if err != nil {
+		return "", err
+	}
+
+	lifetime := i.Lifetime
+	if lifetime <= 0 {
+		lifetime = DefaultTokenLifetime
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", errors.Wrapf(err, "could not generate token ID")
+	}
+
+	now := time.Now()
+	claims := TokenClaims{
+		Issuer:            i.Issuer,
+		Subject:           u.ID,
+		IssuedAt:          now.Unix(),
+		NotBefore:         now.Unix(),
+		Expires:           now.Add(lifetime).Unix(),
+		ID:                hex.EncodeToString(jti),
+		Eppn:              u.Eppn,
+		Name:              u.Displayname,
+		GivenName:         u.Firstname,
+		FamilyName:        u.Lastname,
+		PreferredUsername: u.Username,
+		Email:             u.Email,
+		Orcid:             u.OrcidID,
+		Affiliation:       u.Affiliation,
+		Roles:             u.Roles,
+	}
+
+	switch len(i.Audience) {
+	case 0:
+	case 1:
+		claims.Audience = i.Audience[0]
+	default:
+		claims.Audience = i.Audience
+	}
+
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if i.KeyID != "" {
+		header["kid"] = i.KeyID
+	}
+
+	encodedHeader, err := encodeSegment(header)
+	if err != nil {
+		return "", err
+	}
+	encodedClaims, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encodedHeader + "." + encodedClaims
+	signature, err := signJWS(i.Key, []byte(signingInput))
+	if err != nil {
+		return "", errors.Wrapf(err, "could not sign token")
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// JWKS gives the JSON web key set with the public key verifying tokens
+func (i *TokenIssuer) JWKS() (map[string]interface{}, error) {
+	alg, err := algorithm(i.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	jwk := map[string]string{"use": "sig", "alg": alg}
+	if i.KeyID != "" {
+		jwk["kid"] = i.KeyID
+	}
+
+	switch pub := i.Key.Public().(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk["kty"] = "EC"
+		jwk["crv"] = pub.Curve.Params().Name
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(padded(pub.X, size))
+		jwk["y"] = base64.RawURLEncoding.EncodeToString(padded(pub.Y, size))
+	case ed25519.PublicKey:
+		jwk["kty"] = "OKP"
+		jwk["crv"] = "Ed25519"
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+	}
+
+	return map[string]interface{}{"keys": []interface{}{jwk}}, nil
+}
+
+// algorithm determines the JWS algorithm for the key
+func algorithm(key crypto.Signer) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return "RS256", nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return "ES256", nil
+		case elliptic.P384():
+			return "ES384", nil
+		case elliptic.P521():
+			return "ES512", nil
+		}
+		return "", errors.Errorf("unsupported EC curve %s", k.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return "EdDSA", nil
+	default:
+		return "", errors.Errorf("unsupported signing key type %T", key)
+	}
+}
+
+func signJWS(key crypto.Signer, input []byte) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256(input)
+		return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var digest []byte
+		switch k.Curve {
+		case elliptic.P256():
+			d := sha256.Sum256(input)
+			digest = d[:]
+		case elliptic.P384():
+			d := sha512.Sum384(input)
+			digest = d[:]
+		default:
+			d := sha512.Sum512(input)
+			digest = d[:]
+		}
+
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			return nil, err
+		}
+
+		// JWS EC signatures are the fixed size r and s, not ASN.1
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return append(padded(r, size), padded(s, size)...), nil
+	default:
+		return key.Sign(rand.Reader, input, crypto.Hash(0))
+	}
+}
+
+func padded(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func encodeSegment(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not encode token")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
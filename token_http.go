@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// TokenHeader is the /whoami response header carrying an identity token, if enabled
+const TokenHeader = "X-Identity-Token"
+
+// httpTokenService responds with an identity token (application/jwt) for the
+// user identified by the request's headers
+func httpTokenService(svc userProvider, tokens *TokenIssuer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, err := svc.FromHeaders(r.Header)
+		if err != nil {
+			writeProblem(w, errorProblem(err))
+			return
+		}
+
+		token, err := tokens.Issue(user)
+		if err != nil {
+			log.Printf("Error issuing token for %s: %v", user.ID, err)
+			writeProblem(w, tokenProblem)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/jwt")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write([]byte(token))
+	})
+}
+
+// httpJWKSService responds with the JSON web key set verifying identity tokens
+func httpJWKSService(tokens *TokenIssuer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		jwks, err := tokens.JWKS()
+		if err != nil {
+			log.Printf("Error building JWK set: %v", err)
+			writeProblem(w, Problem{ProblemInternal, "Internal error", http.StatusInternalServerError, "Could not build the JWK set"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		if err := json.NewEncoder(w).Encode(jwks); err != nil {
+			log.Printf("Error encoding JSON response %v", err)
+		}
+	})
+}
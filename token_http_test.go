@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTokenResponse(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	tokens := &TokenIssuer{Key: key}
+
+	provider := FakeUserProvider(func() (*User, error) {
+		return &User{ID: "foo:/bar"}, nil
+	})
+
+	cases := map[string]struct {
+		handler http.Handler
+		token   func(*testing.T, *httptest.ResponseRecorder) string
+	}{
+		"token": {
+			handler: httpTokenService(provider, tokens),
+			token: func(t *testing.T, resp *httptest.ResponseRecorder) string {
+				if resp.Header().Get("Content-Type") != "application/jwt" {
+					t.Fatalf("Bad content type: %s", resp.Header().Get("Content-Type"))
+				}
+				return resp.Body.String()
+			},
+		},
+		"whoami header": {
+			handler: httpUserService(provider, tokens),
+			token: func(t *testing.T, resp *httptest.ResponseRecorder) string {
+				return resp.Header().Get(TokenHeader)
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			tc.handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/", nil))
+			if resp.Code != http.StatusOK {
+				t.Fatalf("Got response code %d", resp.Code)
+			}
+			if resp.Header().Get("Cache-Control") != "no-store" {
+				t.Fatalf("Token response may be cached: %s", resp.Header().Get("Cache-Control"))
+			}
+
+			parts := strings.Split(tc.token(t, resp), ".")
+			if len(parts) != 3 {
+				t.Fatalf("Malformed token %v", parts)
+			}
+			if !ed25519.Verify(key.Public().(ed25519.PublicKey), []byte(parts[0]+"."+parts[1]), decodeSegment(t, parts[2])) {
+				t.Fatalf("Invalid token signature")
+			}
+
+			var claims TokenClaims
+			if err := json.Unmarshal(decodeSegment(t, parts[1]), &claims); err != nil {
+				t.Fatalf("Malformed claims: %v", err)
+			}
+			if claims.Subject != "foo:/bar" {
+				t.Fatalf("Wrong subject %s", claims.Subject)
+			}
+		})
+	}
+}
+
+func TestTokenErrors(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+
+	resp := httptest.NewRecorder()
+	httpTokenService(FakeUserProvider(func() (*User, error) {
+		return nil, ErrorMissingIdentity("Who?")
+	}), &TokenIssuer{Key: key}).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/token", nil))
+
+	if resp.Code != http.StatusUnauthorized || resp.Header().Get("Content-Type") != ProblemContentType {
+		t.Fatalf("Got response code %d, %s", resp.Code, resp.Header().Get("Content-Type"))
+	}
+
+	// P-224 has no JWS algorithm, so tokens cannot be signed
+	unsupported, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	provider := FakeUserProvider(func() (*User, error) {
+		return &User{ID: "foo:/bar"}, nil
+	})
+
+	for _, handler := range []http.Handler{
+		httpTokenService(provider, &TokenIssuer{Key: unsupported}),
+		httpUserService(provider, &TokenIssuer{Key: unsupported}),
+	} {
+		resp = httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/token", nil))
+		if resp.Code != http.StatusInternalServerError || resp.Header().Get(TokenHeader) != "" {
+			t.Fatalf("Got response code %d", resp.Code)
+		}
+		if strings.Contains(resp.Body.String(), "P-224") {
+			t.Fatalf("Problem reveals the signing error: %s", resp.Body.String())
+		}
+	}
+
+	resp = httptest.NewRecorder()
+	httpTokenService(nil, nil).ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/token", nil))
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Method should not be allowed, got %d", resp.Code)
+	}
+}
+
+func TestJWKSResponse(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+
+	resp := httptest.NewRecorder()
+	httpJWKSService(&TokenIssuer{Key: key}).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/jwks", nil))
+
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &jwks); err != nil {
+		t.Fatalf("Malformed JWK set: %v", err)
+	}
+	if len(jwks.Keys) != 1 || jwks.Keys[0]["kty"] != "OKP" || jwks.Keys[0]["crv"] != "Ed25519" ||
+		jwks.Keys[0]["x"] != base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey)) {
+		t.Fatalf("Wrong JWK set %v", jwks)
+	}
+}
+
+func decodeSegment(t *testing.T, segment string) []byte {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		t.Fatalf("Malformed token segment: %v", err)
+	}
+
+	return data
+}
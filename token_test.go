@@ -0,0 +1,266 @@
+package main_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p521Key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	user := &jhuda.User{
+		ID:          "http://example.org/users/bossman@jhu.edu",
+		Username:    "bossman",
+		Firstname:   "Boss",
+		Lastname:    "Man",
+		Displayname: "Boss Man",
+		Email:       "bossman@jhu.edu",
+		Affiliation: []string{"staff@jhu.edu"},
+		Roles:       []string{"submitter", "admin"},
+		Eppn:        "bossman@jhu.edu",
+	}
+
+	cases := map[string]struct {
+		key      crypto.Signer
+		alg      string
+		audience []string
+		expected interface{}
+	}{
+		"RSA": {
+			key: rsaKey,
+			alg: "RS256",
+		},
+		"EC P-256": {
+			key:      p256Key,
+			alg:      "ES256",
+			audience: []string{"pass"},
+			expected: "pass",
+		},
+		"EC P-384": {
+			key:      p384Key,
+			alg:      "ES384",
+			audience: []string{"pass", "deposit"},
+			expected: []interface{}{"pass", "deposit"},
+		},
+		"EC P-521": {
+			key: p521Key,
+			alg: "ES512",
+		},
+		"Ed25519": {
+			key: edKey,
+			alg: "EdDSA",
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			key, err := jhuda.LoadSigningKey(writeKey(t, filepath.Join(dir, name+".pem"), tc.key))
+			if err != nil {
+				t.Fatalf("Could not load key: %v", err)
+			}
+
+			issuer := jhuda.TokenIssuer{
+				Key:      key,
+				KeyID:    "key1",
+				Issuer:   "https://example.org/user-service",
+				Audience: tc.audience,
+				Lifetime: 2 * time.Minute,
+			}
+
+			token, err := issuer.Issue(user)
+			if err != nil {
+				t.Fatalf("Could not issue token: %v", err)
+			}
+
+			header, claims := verifyToken(t, token, tc.key.Public())
+
+			if header["alg"] != tc.alg || header["kid"] != "key1" || header["typ"] != "JWT" {
+				t.Fatalf("Wrong token header %v", header)
+			}
+
+			if claims["exp"].(float64)-claims["iat"].(float64) != 120 {
+				t.Fatalf("Wrong token lifetime, issued %v, expires %v", claims["iat"], claims["exp"])
+			}
+			if claims["jti"] == "" {
+				t.Fatalf("Token has no ID")
+			}
+
+			expected := map[string]interface{}{
+				"iss":                "https://example.org/user-service",
+				"sub":                user.ID,
+				"aud":                tc.expected,
+				"eppn":               "bossman@jhu.edu",
+				"name":               "Boss Man",
+				"given_name":         "Boss",
+				"family_name":        "Man",
+				"preferred_username": "bossman",
+				"email":              "bossman@jhu.edu",
+				"affiliation":        []interface{}{"staff@jhu.edu"},
+				"roles":              []interface{}{"submitter", "admin"},
+			}
+			if tc.expected == nil {
+				delete(expected, "aud")
+			}
+			for _, claim := range []string{"iat", "nbf", "exp", "jti"} {
+				delete(claims, claim)
+			}
+
+			if diffs := deep.Equal(claims, expected); len(diffs) > 0 {
+				t.Fatalf("Wrong claims:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	jwks, err := (&jhuda.TokenIssuer{Key: key, KeyID: "key1"}).JWKS()
+	if err != nil {
+		t.Fatalf("Could not give JWK set: %v", err)
+	}
+
+	jwk := jwks["keys"].([]interface{})[0].(map[string]string)
+
+	x, _ := base64.RawURLEncoding.DecodeString(jwk["x"])
+	y, _ := base64.RawURLEncoding.DecodeString(jwk["y"])
+	if jwk["kty"] != "EC" || jwk["crv"] != "P-256" || jwk["alg"] != "ES256" || jwk["kid"] != "key1" ||
+		new(big.Int).SetBytes(x).Cmp(key.X) != 0 || new(big.Int).SetBytes(y).Cmp(key.Y) != 0 {
+		t.Fatalf("Wrong JWK %v", jwk)
+	}
+}
+
+func TestBadSigningKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p224Key, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	p224DER, _ := x509.MarshalECPrivateKey(p224Key)
+
+	cases := map[string][]byte{
+		"not PEM":           []byte("not a key"),
+		"not a key":         pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("nope")}),
+		"unsupported curve": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: p224DER}),
+	}
+
+	for name, data := range cases {
+		data := data
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, "key.pem")
+			if err := ioutil.WriteFile(path, data, 0600); err != nil {
+				t.Fatalf("Could not write key: %v", err)
+			}
+
+			if _, err := jhuda.LoadSigningKey(path); err == nil {
+				t.Fatalf("Expected an error loading the key")
+			}
+		})
+	}
+
+	if _, err := jhuda.LoadSigningKey(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Fatalf("Expected an error loading a missing key")
+	}
+}
+
+// writeKey writes the key as a PKCS#8 PEM file
+func writeKey(t *testing.T, path string, key crypto.Signer) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %v", err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, keyPEM, 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+
+	return path
+}
+
+// verifyToken verifies the token's signature, giving its header and claims
+func verifyToken(t *testing.T, token string, pub crypto.PublicKey) (header, claims map[string]interface{}) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Malformed token %s", token)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("Malformed signature: %v", err)
+	}
+	input := []byte(parts[0] + "." + parts[1])
+
+	var valid bool
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(input)
+		valid = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch k.Curve {
+		case elliptic.P256():
+			d := sha256.Sum256(input)
+			digest = d[:]
+		case elliptic.P384():
+			d := sha512.Sum384(input)
+			digest = d[:]
+		default:
+			d := sha512.Sum512(input)
+			digest = d[:]
+		}
+		size := len(signature) / 2
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		valid = size == (k.Curve.Params().BitSize+7)/8 && ecdsa.Verify(k, digest, r, s)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, input, signature)
+	}
+	if !valid {
+		t.Fatalf("Invalid token signature")
+	}
+
+	for i, v := range []*map[string]interface{}{&header, &claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatalf("Malformed token segment: %v", err)
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("Malformed token segment: %v", err)
+		}
+	}
+
+	return header, claims
+}
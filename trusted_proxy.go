@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultProxySecretHeader is the default header carrying the trusted proxy's shared secret
+const DefaultProxySecretHeader = "X-Proxy-Secret"
+
+// TrustedProxy rejects requests that do not come from a trusted proxy (e.g. the
+// Shibboleth SP), before any identity headers are read.  Otherwise, anyone who
+// can reach the service directly could claim any identity.  Each configured
+// check must pass; if none are configured, every request is trusted.  Requests
+// over unix sockets are not checked against the networks or for a client
+// certificate, as they have neither, and the socket's permissions restrict who
+// may connect.
+type TrustedProxy struct {
+	Networks     []*net.IPNet // Remote addresses trusted, any if empty
+	SecretHeader string       // Header carrying the shared secret, DefaultProxySecretHeader if empty
+	Secret       string       // Shared secret the proxy must send, not checked if empty
+	ClientCert   bool         // Require a verified TLS client certificate
+	ClientNames  []string     // Client certificate subject CNs or DNS names trusted, any verified if empty
+}
+
+// ParseNetworks parses CIDR networks, e.g. 10.0.0.0/8.  A bare IP address is a
+// network of just that address.
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.Errorf("malformed IP address '%s'", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "malformed network")
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// Wrap rejects untrusted requests with 403, passing the rest to the handler
+func (p *TrustedProxy) Wrap(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := p.check(r); err != nil {
+			writeProblem(w, Problem{
+				Type:   ProblemUntrustedProxy,
+				Title:  "Untrusted proxy",
+				Status: http.StatusForbidden,
+				Detail: err.Error(),
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *TrustedProxy) check(r *http.Request) error {
+	if len(p.Networks) > 0 && !overUnixSocket(r) && !p.trustedAddress(r.RemoteAddr) {
+		return errors.Errorf("requests from %s are not trusted", r.RemoteAddr)
+	}
+
+	if p.Secret != "" {
+		secret := r.Header.Get(oneOf(p.SecretHeader, DefaultProxySecretHeader))
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(p.Secret)) != 1 {
+			return errors.Errorf("missing or incorrect proxy secret")
+		}
+	}
+
+	if p.ClientCert && !overUnixSocket(r) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return errors.Errorf("no verified client certificate")
+		}
+		if !p.trustedName(r) {
+			return errors.Errorf("client certificate %s is not trusted", r.TLS.VerifiedChains[0][0].Subject.CommonName)
+		}
+	}
+
+	return nil
+}
+
+func (p *TrustedProxy) trustedAddress(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range p.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func overUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+func (p *TrustedProxy) trustedName(r *http.Request) bool {
+	if len(p.ClientNames) == 0 {
+		return true
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, trusted := range p.ClientNames {
+		for _, name := range names {
+			if strings.EqualFold(trusted, name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,156 @@
+package main_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestTrustedProxy(t *testing.T) {
+	networks, err := jhuda.ParseNetworks([]string{"10.0.0.0/8", "192.168.1.5", "::1"})
+	if err != nil {
+		t.Fatalf("Could not parse networks: %v", err)
+	}
+
+	clientCert := func(cn string, dnsNames ...string) *tls.ConnectionState {
+		return &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{
+				Subject:  pkix.Name{CommonName: cn},
+				DNSNames: dnsNames,
+			}}},
+		}
+	}
+
+	cases := map[string]struct {
+		proxy      *jhuda.TrustedProxy
+		remoteAddr string
+		secret     string
+		tls        *tls.ConnectionState
+		unix       bool
+		trusted    bool
+	}{
+		"no proxy": {
+			remoteAddr: "203.0.113.1:1234",
+			trusted:    true,
+		},
+		"trusted network": {
+			proxy:      &jhuda.TrustedProxy{Networks: networks},
+			remoteAddr: "10.1.2.3:1234",
+			trusted:    true,
+		},
+		"trusted address": {
+			proxy:      &jhuda.TrustedProxy{Networks: networks},
+			remoteAddr: "192.168.1.5:1234",
+			trusted:    true,
+		},
+		"trusted ipv6 address": {
+			proxy:      &jhuda.TrustedProxy{Networks: networks},
+			remoteAddr: "[::1]:1234",
+			trusted:    true,
+		},
+		"untrusted address": {
+			proxy:      &jhuda.TrustedProxy{Networks: networks},
+			remoteAddr: "192.168.1.6:1234",
+		},
+		"secret": {
+			proxy:      &jhuda.TrustedProxy{Secret: "s3cret"},
+			remoteAddr: "203.0.113.1:1234",
+			secret:     "s3cret",
+			trusted:    true,
+		},
+		"wrong secret": {
+			proxy:      &jhuda.TrustedProxy{Secret: "s3cret"},
+			remoteAddr: "203.0.113.1:1234",
+			secret:     "guess",
+		},
+		"missing secret": {
+			proxy:      &jhuda.TrustedProxy{Secret: "s3cret"},
+			remoteAddr: "203.0.113.1:1234",
+		},
+		"trusted network, wrong secret": {
+			proxy:      &jhuda.TrustedProxy{Networks: networks, Secret: "s3cret"},
+			remoteAddr: "10.1.2.3:1234",
+			secret:     "guess",
+		},
+		"client cert": {
+			proxy:   &jhuda.TrustedProxy{ClientCert: true},
+			tls:     clientCert("sp.example.org"),
+			trusted: true,
+		},
+		"no client cert": {
+			proxy: &jhuda.TrustedProxy{ClientCert: true},
+			tls:   &tls.ConnectionState{},
+		},
+		"no tls": {
+			proxy: &jhuda.TrustedProxy{ClientCert: true},
+		},
+		"trusted client name": {
+			proxy:   &jhuda.TrustedProxy{ClientCert: true, ClientNames: []string{"sp.example.org"}},
+			tls:     clientCert("Shibboleth SP", "SP.example.org"),
+			trusted: true,
+		},
+		"untrusted client name": {
+			proxy: &jhuda.TrustedProxy{ClientCert: true, ClientNames: []string{"sp.example.org"}},
+			tls:   clientCert("other.example.org"),
+		},
+		"unix socket": {
+			proxy:      &jhuda.TrustedProxy{Networks: networks},
+			remoteAddr: "@",
+			unix:       true,
+			trusted:    true,
+		},
+		"client cert over unix socket": {
+			proxy:   &jhuda.TrustedProxy{ClientCert: true, ClientNames: []string{"sp.example.org"}},
+			unix:    true,
+			trusted: true,
+		},
+		"unix socket, wrong secret": {
+			proxy:  &jhuda.TrustedProxy{ClientCert: true, Secret: "s3cret"},
+			secret: "guess",
+			unix:   true,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.TLS = tc.tls
+			if tc.unix {
+				req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/user-service.sock", Net: "unix"}))
+			}
+			if tc.secret != "" {
+				req.Header.Set(jhuda.DefaultProxySecretHeader, tc.secret)
+			}
+
+			reached := false
+			resp := httptest.NewRecorder()
+			tc.proxy.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			})).ServeHTTP(resp, req)
+
+			if reached != tc.trusted {
+				t.Fatalf("Expected trusted to be %t, but handler reached was %t", tc.trusted, reached)
+			}
+			if !tc.trusted && resp.Code != http.StatusForbidden {
+				t.Fatalf("Got code %d, but expected %d", resp.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestBadNetworks(t *testing.T) {
+	for _, bad := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0/8"} {
+		if _, err := jhuda.ParseNetworks([]string{bad}); err == nil {
+			t.Errorf("Expected '%s' to be invalid", bad)
+		}
+	}
+}
@@ -6,19 +6,23 @@ import (
 )
 
 type User struct {
-	ID          string   `json:"@id"`
-	Type        string   `json:"@type,omitempty"`
-	Context     string   `json:"@context,omitempty"`
-	Username    string   `json:"username,omitempty"`
-	Firstname   string   `json:"firstName,omitempty"`
-	Middlename  string   `json:"middleName,omitempty"`
-	Lastname    string   `json:"lastName,omitempty"`
-	Displayname string   `json:"displayName,omitempty"`
-	Email       string   `json:"email,omitempty"`
-	Affiliation []string `json:"affiliation,omitempty"`
-	Locatorids  []string `json:"locatorIds,omitempty"`
-	OrcidID     string   `json:"orcidId,omitempty"`
-	Roles       []string `json:"roles,omitempty"`
+	Eppn             string              `json:"-"` // Eppn the user was resolved from, not serialized
+	Groups           []string            `json:"-"` // Groups and entitlements the user was released with, not serialized
+	Locators         map[string][]string `json:"-"` // Raw values of locator headers, by header, not serialized
+	IdentityProvider string              `json:"-"` // Entity ID of the IdP the user logged in with, not serialized
+	ID               string              `json:"@id"`
+	Type             string              `json:"@type,omitempty"`
+	Context          string              `json:"@context,omitempty"`
+	Username         string              `json:"username,omitempty"`
+	Firstname        string              `json:"firstName,omitempty"`
+	Middlename       string              `json:"middleName,omitempty"`
+	Lastname         string              `json:"lastName,omitempty"`
+	Displayname      string              `json:"displayName,omitempty"`
+	Email            string              `json:"email,omitempty"`
+	Affiliation      []string            `json:"affiliation,omitempty"`
+	Locatorids       []string            `json:"locatorIds,omitempty"`
+	OrcidID          string              `json:"orcidId,omitempty"`
+	Roles            []string            `json:"roles,omitempty"`
 }
 
 func (u *User) Serialize(w io.Writer) error {
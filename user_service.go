@@ -1,8 +1,9 @@
 package main
 
 import (
-	"fmt"
-	"strings"
+	"log"
+	"net/textproto"
+	"sort"
 
 	"github.com/pkg/errors"
 )
@@ -20,34 +21,147 @@ type RoleLookup interface {
 // UserService provides the identity and information associated with a User by inspecting
 // Http headers
 type UserService struct {
-	UserBase      string      // BaseURI for user IDs, e.g. http://archive.local/fcrepo/rest/users/
-	JsonldContext string      // JSON-LD context URI for User resources
-	HeaderDefs    ShibHeaders // Header definitions
-	Roles         RoleLookup  // Role lookup service
+	UserBase        string             // BaseURI for user IDs, e.g. http://archive.local/fcrepo/rest/users/
+	JsonldContext   string             // JSON-LD context URI for User resources
+	HeaderDefs      ShibHeaders        // Header definitions
+	Values          ValueParser        // Parser for multi-valued headers
+	Affiliation     AffiliationPolicy  // Filtering of affiliation values
+	EppnUsername    bool               // Use the local part of the eppn as username, if there is no username header
+	Attributes      *AttributeMappings // Mappings replacing those given by the header definitions
+	IDs             IDScheme           // Scheme for user IDs, the raw eppn if nil
+	Locators        LocatorFormat      // Format of locator IDs
+	MaxHeaderLength int                // Maximum length of header values, DefaultMaxHeaderLength if zero
+	Identity        IdentityPolicy     // Identity providers and eppn domains accepted
+	Roles           RoleLookup         // Role lookup service
 }
 
-func (u UserService) FromHeaders(headers HeaderProvider) (*User, error) {
-	eppn := headers.Get(oneOf(u.HeaderDefs.Eppn, DefaultShibHeaders.Eppn))
+func (u UserService) FromHeaders(provided HeaderProvider) (*User, error) {
+	maxLength := u.MaxHeaderLength
+	if maxLength <= 0 {
+		maxLength = DefaultMaxHeaderLength
+	}
+	headers := &checkedHeaders{headers: provided, maxLength: maxLength}
+
+	eppn := u.first(headers, u.HeaderDefs.Eppn, DefaultShibHeaders.Eppn)
+	if headers.err != nil {
+		return nil, headers.err
+	}
+
+	if err := validateEppn(eppn, oneOf(u.HeaderDefs.Eppn, DefaultShibHeaders.Eppn)); err != nil {
+		return nil, err
+	}
+
+	idp := u.first(headers, u.HeaderDefs.IdentityProvider, DefaultShibHeaders.IdentityProvider)
+	if err := u.Identity.Check(eppn, idp); err != nil {
+		return nil, err
+	}
+
+	var ids IDScheme = EppnID{}
+	if u.IDs != nil {
+		ids = u.IDs
+	}
 
-	if !strings.Contains(eppn, "@") {
-		return nil, ErrorBadInput(fmt.Sprintf("Eppn is expected to be user@domain, instead got '%s'", eppn))
+	id, err := ids.ID(eppn, headers)
+	if err != nil {
+		return nil, err
 	}
 
 	user := &User{
-		ID:          u.UserBase + eppn,
-		Type:        "User",
-		Context:     u.JsonldContext,
-		Displayname: headers.Get(oneOf(u.HeaderDefs.Displayname, DefaultShibHeaders.Displayname)),
-		Firstname:   headers.Get(oneOf(u.HeaderDefs.GivenName, DefaultShibHeaders.GivenName)),
-		Lastname:    headers.Get(oneOf(u.HeaderDefs.LastName, DefaultShibHeaders.LastName)),
-		Email:       headers.Get(oneOf(u.HeaderDefs.Email, DefaultShibHeaders.Email)),
-		Locatorids:  u.locatorIds(u.HeaderDefs.LocatorIDs, headers),
+		Eppn:             eppn,
+		IdentityProvider: idp,
+		ID:               u.UserBase + id,
+		Type:             "User",
+		Context:          u.JsonldContext,
+		Groups:           u.groups(u.HeaderDefs.Groups, headers),
+	}
+
+	for _, mapping := range u.mappings() {
+		if err := mapping.apply(user, headers, u.Values); err != nil {
+			return nil, err
+		}
+	}
+
+	if !u.Attributes.Mapped("locatorIds") {
+		u.locatorIds(user, u.HeaderDefs.LocatorIDs, headers)
+	}
+	if user.Username == "" && u.EppnUsername {
+		user.Username, _ = splitEppn(eppn)
+	}
+	user.OrcidID = normalizeOrcidOrIgnore(user.OrcidID)
+	user.Affiliation = u.Affiliation.Apply(user.Affiliation)
+
+	if headers.err != nil {
+		return nil, headers.err
+	}
+	if err := validateEmail(user.Email); err != nil {
+		return nil, err
 	}
 
 	return u.addRoles(user)
 }
 
-func (u UserService) locatorIds(locators []string, headers HeaderProvider) []string {
+// mappings gives the attribute mappings from the header definitions, replaced
+// by any configured mappings of the same properties
+func (u UserService) mappings() []AttributeMapping {
+	if u.Attributes == nil {
+		return u.HeaderDefs.Mappings()
+	}
+
+	var mappings []AttributeMapping
+	for _, mapping := range u.HeaderDefs.Mappings() {
+		if !u.Attributes.Mapped(mapping.Property) {
+			mappings = append(mappings, mapping)
+		}
+	}
+
+	return append(mappings, u.Attributes.Attributes...)
+}
+
+// IdentityHeaders gives the canonical names of every header the user is
+// resolved from, sorted
+func (u UserService) IdentityHeaders() []string {
+	names := []string{
+		oneOf(u.HeaderDefs.Eppn, DefaultShibHeaders.Eppn),
+		oneOf(u.HeaderDefs.IdentityProvider, DefaultShibHeaders.IdentityProvider),
+	}
+
+	for _, mapping := range u.mappings() {
+		names = append(names, mapping.Headers...)
+	}
+
+	locators, groups := u.HeaderDefs.LocatorIDs, u.HeaderDefs.Groups
+	if locators == nil {
+		locators = DefaultShibHeaders.LocatorIDs
+	}
+	if groups == nil {
+		groups = DefaultShibHeaders.Groups
+	}
+	names = append(append(names, locators...), groups...)
+
+	if ids, ok := u.IDs.(LocatorHeaderID); ok {
+		names = append(names, ids.Header)
+	}
+
+	seen := map[string]bool{}
+	var headers []string
+	for _, name := range names {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			headers = append(headers, name)
+		}
+	}
+	sort.Strings(headers)
+
+	return headers
+}
+
+// first gets the first value of a possibly multi-valued header
+func (u UserService) first(headers HeaderProvider, header, defaultHeader string) string {
+	return u.Values.First(headers.Get(oneOf(header, defaultHeader)))
+}
+
+func (u UserService) locatorIds(user *User, locators []string, headers HeaderProvider) {
 
 	// If locator headers slice is nil (undefined), then use the defaults.
 	// Note: this differs from an explicitly allocated empty slice, which is used
@@ -56,18 +170,56 @@ func (u UserService) locatorIds(locators []string, headers HeaderProvider) []str
 		locators = DefaultShibHeaders.LocatorIDs
 	}
 
-	var locatorIds []string
-
-	domain := strings.Split(headers.Get(oneOf(u.HeaderDefs.Eppn, DefaultShibHeaders.Eppn)), "@")[1]
+	_, domain := splitEppn(user.Eppn)
 
+	// Each value of a multi-valued locator header is a locator ID of its own
 	for _, locator := range locators {
-		val := headers.Get(locator)
-		if val != "" {
-			locatorIds = append(locatorIds, domain+":"+locator+":"+val)
+		values := u.Values.Split(headers.Get(locator))
+		if len(values) == 0 {
+			continue
 		}
+
+		if user.Locators == nil {
+			user.Locators = map[string][]string{}
+		}
+		user.Locators[locator] = values
+
+		for _, val := range values {
+			user.Locatorids = append(user.Locatorids, u.Locators.Format(locator, val, domain))
+		}
+	}
+}
+
+func (u UserService) groups(groupHeaders []string, headers HeaderProvider) []string {
+
+	// As with locators, a nil slice means use the defaults
+	if groupHeaders == nil {
+		groupHeaders = DefaultShibHeaders.Groups
+	}
+
+	var groups []string
+
+	for _, header := range groupHeaders {
+		groups = append(groups, u.Values.Split(headers.Get(header))...)
+	}
+
+	return groups
+}
+
+// normalizeOrcidOrIgnore normalizes an ORCID iD, if present.  Malformed ORCID
+// iDs are logged and ignored, rather than denying the user an identity
+func normalizeOrcidOrIgnore(val string) string {
+	if val == "" {
+		return ""
+	}
+
+	orcid, err := NormalizeOrcid(val)
+	if err != nil {
+		log.Printf("Ignoring ORCID iD: %v", err)
+		return ""
 	}
 
-	return locatorIds
+	return orcid
 }
 
 func (u UserService) addRoles(user *User) (*User, error) {
@@ -84,18 +236,35 @@ func (u UserService) addRoles(user *User) (*User, error) {
 
 	roles, err := u.Roles.Lookup(user)
 	if err != nil {
-		return nil, errors.Errorf("Error determining roles for %s", user.ID)
+		// The cause may reveal internals such as LDAP filters or URLs, so is only logged
+		log.Printf("Error determining roles for %s: %v", user.ID, err)
+		if _, ok := errors.Cause(err).(ErrorUpstream); ok {
+			return nil, ErrorUpstream("Role lookup failed")
+		}
+		return nil, errors.New("Role lookup failed")
 	}
 
+	for _, r := range dedupeRoles(uniqueRoles, roles) {
+		user.Roles = append(user.Roles, r.Simple())
+	}
+
+	return user, nil
+}
+
+// dedupeRoles filters out any roles whose simple name has already been seen,
+// and records the names of those that remain.
+func dedupeRoles(seen map[string]bool, roles []Role) []Role {
+	var unique []Role
+
 	for _, r := range roles {
 		role := r.Simple()
-		if !uniqueRoles[role] {
-			uniqueRoles[role] = true
-			user.Roles = append(user.Roles, role)
+		if !seen[role] {
+			seen[role] = true
+			unique = append(unique, r)
 		}
 	}
 
-	return user, nil
+	return unique
 }
 
 func oneOf(val, defaultVal string) string {
@@ -3,15 +3,15 @@ package main
 import (
 	"log"
 	"net/http"
-
-	"github.com/pkg/errors"
 )
 
 type userProvider interface {
 	FromHeaders(headers HeaderProvider) (*User, error)
 }
 
-func httpUserService(svc userProvider) http.Handler {
+// httpUserService responds with the user identified by the request's headers,
+// and an identity token in TokenHeader if tokens are given
+func httpUserService(svc userProvider, tokens *TokenIssuer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -20,15 +20,21 @@ func httpUserService(svc userProvider) http.Handler {
 
 		user, err := svc.FromHeaders(r.Header)
 		if err != nil {
-			if _, ok := errors.Cause(err).(ErrorBadInput); ok {
-				w.WriteHeader(http.StatusBadRequest)
-			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-			_, _ = w.Write([]byte(err.Error()))
+			writeProblem(w, errorProblem(err))
 			return
 		}
 
+		if tokens != nil {
+			token, err := tokens.Issue(user)
+			if err != nil {
+				log.Printf("Error issuing token for %s: %v", user.ID, err)
+				writeProblem(w, tokenProblem)
+				return
+			}
+			w.Header().Set(TokenHeader, token)
+			w.Header().Set("Cache-Control", "no-store")
+		}
+
 		w.Header().Add("Content-Type", "application/json;charset=utf-8")
 		err = user.Serialize(w)
 		if err != nil {
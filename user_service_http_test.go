@@ -15,7 +15,7 @@ func TestMethodNotAllowed(t *testing.T) {
 
 	for _, method := range []string{http.MethodPost, http.MethodDelete, http.MethodPut} {
 		resp := httptest.NewRecorder()
-		httpUserService(nil).ServeHTTP(resp, httptest.NewRequest(method, "/whoami", nil))
+		httpUserService(nil, nil).ServeHTTP(resp, httptest.NewRequest(method, "/whoami", nil))
 
 		if resp.Code != http.StatusMethodNotAllowed {
 			t.Errorf("Method should not be allowed: %s", method)
@@ -33,14 +33,40 @@ func TestBadRequest(t *testing.T) {
 	cases := map[string]struct {
 		err          error
 		expectedCode int
+		expectedType string
+		detail       string // Expected detail, if not the error
 	}{
 		"bad requst": {
 			err:          ErrorBadInput("Nooo"),
 			expectedCode: http.StatusBadRequest,
+			expectedType: ProblemInvalidIdentity,
+		},
+		"missing identity": {
+			err:          ErrorMissingIdentity("Who?"),
+			expectedCode: http.StatusUnauthorized,
+			expectedType: ProblemMissingIdentity,
+		},
+		"forbidden domain": {
+			err:          ErrorForbiddenDomain("Not here"),
+			expectedCode: http.StatusForbidden,
+			expectedType: ProblemForbiddenDomain,
+		},
+		"forbidden idp": {
+			err:          ErrorForbiddenIdP("Not them"),
+			expectedCode: http.StatusForbidden,
+			expectedType: ProblemForbiddenIdP,
+		},
+		"upstream failure": {
+			err:          ErrorUpstream("LDAP is down"),
+			expectedCode: http.StatusBadGateway,
+			expectedType: ProblemUpstreamFailure,
+			detail:       "A service the user service depends on failed",
 		},
 		"internal error": {
 			err:          errors.New("Boooo"),
 			expectedCode: http.StatusInternalServerError,
+			expectedType: ProblemInternal,
+			detail:       "The user service failed",
 		},
 	}
 
@@ -51,11 +77,35 @@ func TestBadRequest(t *testing.T) {
 
 			httpUserService(FakeUserProvider(func() (*User, error) {
 				return nil, tc.err
-			})).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/whoami", nil))
+			}), nil).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/whoami", nil))
 
 			if resp.Code != tc.expectedCode {
 				t.Fatalf("Got code %d, but expected %d", resp.Code, tc.expectedCode)
 			}
+
+			if resp.Header().Get("Content-Type") != ProblemContentType {
+				t.Fatalf("Bad content type: %s", resp.Header().Get("Content-Type"))
+			}
+
+			var problem Problem
+			if err := json.Unmarshal(resp.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("Could not read problem: %v", err)
+			}
+
+			detail := tc.detail
+			if detail == "" {
+				detail = tc.err.Error()
+			}
+
+			diffs := deep.Equal(problem, Problem{
+				Type:   tc.expectedType,
+				Title:  problem.Title,
+				Status: tc.expectedCode,
+				Detail: detail,
+			})
+			if len(diffs) > 0 {
+				t.Fatalf("Got unexpected problem:\n%s", strings.Join(diffs, "\n"))
+			}
 		})
 	}
 }
@@ -70,7 +120,7 @@ func TestResponse(t *testing.T) {
 	resp := httptest.NewRecorder()
 	httpUserService(FakeUserProvider(func() (*User, error) {
 		return user, nil
-	})).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/whoami", nil))
+	}), nil).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/whoami", nil))
 
 	var returnedUser User
 	err := json.Unmarshal(resp.Body.Bytes(), &returnedUser)
@@ -108,7 +158,7 @@ func TestSerializationError(t *testing.T) {
 	resp := &CannotWrite{}
 	httpUserService(FakeUserProvider(func() (*User, error) {
 		return &User{}, nil
-	})).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/whoami", nil))
+	}), nil).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/whoami", nil))
 
 	if resp.code != http.StatusInternalServerError {
 		t.Fatalf("Got wrong response code: %d, expected: %d", resp.code, http.StatusInternalServerError)
@@ -2,6 +2,7 @@ package main_test
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"testing"
@@ -42,6 +43,7 @@ func TestLocatorIDs(t *testing.T) {
 			"Bar":                 {"bar"},
 		},
 		expected: &jhuda.User{
+			Eppn:        "foo@example.org",
 			ID:          "http://example.org/fcrepo/rest/users/foo@example.org",
 			Type:        "User",
 			Firstname:   "Bo",
@@ -49,6 +51,7 @@ func TestLocatorIDs(t *testing.T) {
 			Displayname: "MOOO",
 			Email:       "me@example.org",
 			Locatorids:  []string{"example.org:Foo:foo", "example.org:Bar:bar"},
+			Locators:    map[string][]string{"Foo": {"foo"}, "Bar": {"bar"}},
 		},
 	}, {
 		name: "default headers",
@@ -62,6 +65,7 @@ func TestLocatorIDs(t *testing.T) {
 			"Unique-Id":      {"bar"},
 		},
 		expected: &jhuda.User{
+			Eppn:        "foo@example.org",
 			ID:          "http://example.org/fcrepo/rest/users/foo@example.org",
 			Type:        "User",
 			Firstname:   "Bo",
@@ -73,6 +77,11 @@ func TestLocatorIDs(t *testing.T) {
 				"example.org:unique-id:bar",
 				"example.org:Eppn:foo@example.org",
 			},
+			Locators: map[string][]string{
+				"Employeenumber": {"foo"},
+				"unique-id":      {"bar"},
+				"Eppn":           {"foo@example.org"},
+			},
 		},
 	}, {
 		name: "sparse",
@@ -87,6 +96,7 @@ func TestLocatorIDs(t *testing.T) {
 			"Unique-Id":      {"bar"},
 		},
 		expected: &jhuda.User{
+			Eppn:        "foo@example.org",
 			ID:          "http://example.org/fcrepo/rest/users/foo@example.org",
 			Type:        "User",
 			Displayname: "MOOO",
@@ -116,29 +126,82 @@ func TestLocatorIDs(t *testing.T) {
 }
 
 func TestBadEppn(t *testing.T) {
-	cases := map[string]map[string][]string{
+	cases := map[string]struct {
+		headers  map[string][]string
+		domains  []string
+		expected error
+	}{
 		"Malformed eppn": {
-			"Eppn": {"FooBar"},
+			headers:  map[string][]string{"Eppn": {"FooBar"}},
+			expected: jhuda.ErrorBadInput(""),
+		},
+		"Two @": {
+			headers:  map[string][]string{"Eppn": {"foo@bar@example.org"}},
+			expected: jhuda.ErrorBadInput(""),
+		},
+		"Bad domain": {
+			headers:  map[string][]string{"Eppn": {"foo@-example.org"}},
+			expected: jhuda.ErrorBadInput(""),
+		},
+		"Whitespace": {
+			headers:  map[string][]string{"Eppn": {"foo bar@example.org"}},
+			expected: jhuda.ErrorBadInput(""),
+		},
+		"Too long": {
+			headers:  map[string][]string{"Eppn": {strings.Repeat("a", 250) + "@example.org"}},
+			expected: jhuda.ErrorBadInput(""),
 		},
 		"No eppn": {
-			"Foo": {"Bar"},
+			headers:  map[string][]string{"Foo": {"Bar"}},
+			expected: jhuda.ErrorMissingIdentity(""),
+		},
+		"Control character": {
+			headers:  map[string][]string{"Eppn": {"foo@example.org"}, "Displayname": {"Foo\x00Bar"}},
+			expected: jhuda.ErrorBadInput(""),
+		},
+		"Header too long": {
+			headers:  map[string][]string{"Eppn": {"foo@example.org"}, "Ismemberof": {strings.Repeat("a", jhuda.DefaultMaxHeaderLength+1)}},
+			expected: jhuda.ErrorBadInput(""),
+		},
+		"Malformed email": {
+			headers:  map[string][]string{"Eppn": {"foo@example.org"}, "Mail": {"foo"}},
+			expected: jhuda.ErrorBadInput(""),
+		},
+		"Forbidden domain": {
+			headers:  map[string][]string{"Eppn": {"foo@example.org"}},
+			domains:  []string{"jhu.edu", "@jhmi.edu"},
+			expected: jhuda.ErrorForbiddenDomain(""),
 		},
 	}
 
-	for name, headers := range cases {
-		headers := http.Header(headers)
+	for name, tc := range cases {
+		tc := tc
 		t.Run(name, func(t *testing.T) {
 			_, err := jhuda.UserService{
 				HeaderDefs: jhuda.DefaultShibHeaders,
-			}.FromHeaders(headers)
+				Identity:   jhuda.IdentityPolicy{AllowedDomains: tc.domains},
+			}.FromHeaders(http.Header(tc.headers))
 
 			if err == nil {
 				t.Fatalf("Expected error!")
 			}
+			if fmt.Sprintf("%T", err) != fmt.Sprintf("%T", tc.expected) {
+				t.Fatalf("Expected a %T, but got %T: %v", tc.expected, err, err)
+			}
 		})
 	}
 }
 
+func TestAllowedDomains(t *testing.T) {
+	us := jhuda.UserService{Identity: jhuda.IdentityPolicy{AllowedDomains: []string{"jhu.edu", "@JHMI.edu"}}}
+
+	for _, eppn := range []string{"foo@jhu.edu", "foo@jhmi.edu", "Foo@JHU.EDU"} {
+		if _, err := us.FromHeaders(http.Header{"Eppn": {eppn}}); err != nil {
+			t.Errorf("Expected %s to be allowed, but got %v", eppn, err)
+		}
+	}
+}
+
 type FakeRoleLookup struct {
 	roles []jhuda.Role
 	err   error
@@ -215,6 +278,44 @@ func TestRoles(t *testing.T) {
 	}
 }
 
+func TestRoleErrors(t *testing.T) {
+	cases := map[string]struct {
+		upstream bool
+		expected string
+	}{
+		"upstream source": {
+			upstream: true,
+			expected: "main.ErrorUpstream",
+		},
+		"local source": {
+			expected: "*errors.fundamental",
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, err := jhuda.UserService{
+				Roles: jhuda.CompositeRoleLookup{Sources: []jhuda.RoleSource{{
+					Name:     "ldap",
+					Roles:    FakeRoleLookup{err: errors.New("LDAP search for (uid=foo) at ldap://secret.example.org failed")},
+					Upstream: tc.upstream,
+				}}},
+			}.FromHeaders(http.Header{"Eppn": {"foo@example.org"}})
+
+			if err == nil {
+				t.Fatalf("Expected an error")
+			}
+			if strings.Contains(err.Error(), "secret") {
+				t.Fatalf("Error reveals internals: %v", err)
+			}
+			if got := fmt.Sprintf("%T", err); got != tc.expected {
+				t.Fatalf("Got error of type %s, expected %s", got, tc.expected)
+			}
+		})
+	}
+}
+
 func TestContext(t *testing.T) {
 	cases := map[string]struct {
 		context  string
@@ -222,18 +323,22 @@ func TestContext(t *testing.T) {
 	}{
 		"no context": {
 			expected: &jhuda.User{
+				Eppn:       "foo@example.org",
 				ID:         "foo@example.org",
 				Type:       "User",
 				Locatorids: []string{"example.org:Eppn:foo@example.org"},
+				Locators:   map[string][]string{"Eppn": {"foo@example.org"}},
 			},
 		},
 		"defined context": {
 			context: "http://example.org/context/",
 			expected: &jhuda.User{
+				Eppn:       "foo@example.org",
 				ID:         "foo@example.org",
 				Type:       "User",
 				Context:    "http://example.org/context/",
 				Locatorids: []string{"example.org:Eppn:foo@example.org"},
+				Locators:   map[string][]string{"Eppn": {"foo@example.org"}},
 			},
 		},
 	}
@@ -258,3 +363,313 @@ func TestContext(t *testing.T) {
 		})
 	}
 }
+
+func TestGroups(t *testing.T) {
+	cases := map[string]struct {
+		groupHeaders []string
+		headers      map[string][]string
+		expected     []string
+	}{
+		"default headers": {
+			headers: map[string][]string{
+				"Ismemberof":  {"urn:a;urn:b; urn:c"},
+				"Entitlement": {"urn:d"},
+			},
+			expected: []string{"urn:d", "urn:a", "urn:b", "urn:c"},
+		},
+		"custom headers": {
+			groupHeaders: []string{"Groups"},
+			headers: map[string][]string{
+				"Groups":     {"urn:a;;urn:b"},
+				"Ismemberof": {"urn:c"},
+			},
+			expected: []string{"urn:a", "urn:b"},
+		},
+		"explicitly no group headers": {
+			groupHeaders: []string{},
+			headers: map[string][]string{
+				"Ismemberof": {"urn:a"},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			tc.headers["Eppn"] = []string{"foo@example.org"}
+
+			user, err := jhuda.UserService{
+				HeaderDefs: jhuda.ShibHeaders{Groups: tc.groupHeaders},
+			}.FromHeaders(http.Header(tc.headers))
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+
+			diffs := deep.Equal(user.Groups, tc.expected)
+			if len(diffs) > 0 {
+				t.Fatalf("Did not get expected groups:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+func TestMultiValuedHeaders(t *testing.T) {
+	user, err := jhuda.UserService{
+		HeaderDefs: jhuda.ShibHeaders{
+			LocatorIDs: []string{"Employeenumber", "Eppn"},
+		},
+	}.FromHeaders(http.Header(map[string][]string{
+		"Eppn":           {"foo@example.org;bar@example.org"},
+		"Mail":           {"me@example.org;alias@example.org"},
+		"Displayname":    {`Bo\; Vine`},
+		"Employeenumber": {`123;4\;56`},
+	}))
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+
+	expected := &jhuda.User{
+		Eppn:        "foo@example.org",
+		ID:          "foo@example.org",
+		Type:        "User",
+		Email:       "me@example.org",
+		Displayname: "Bo; Vine",
+		Locatorids: []string{
+			"example.org:Employeenumber:123",
+			"example.org:Employeenumber:4;56",
+			"example.org:Eppn:foo@example.org",
+			"example.org:Eppn:bar@example.org",
+		},
+		Locators: map[string][]string{
+			"Employeenumber": {"123", "4;56"},
+			"Eppn":           {"foo@example.org", "bar@example.org"},
+		},
+	}
+
+	diffs := deep.Equal(user, expected)
+	if len(diffs) > 0 {
+		t.Fatalf("Did not get back expected user!\n%s", strings.Join(diffs, "\n"))
+	}
+}
+
+func TestAffiliation(t *testing.T) {
+	cases := map[string]struct {
+		affiliationHeaders []string
+		policy             jhuda.AffiliationPolicy
+		headers            map[string][]string
+		expected           []string
+	}{
+		"scoped": {
+			headers: map[string][]string{
+				"Affiliation": {"staff@jhu.edu;faculty@jhu.edu"},
+			},
+			expected: []string{"staff@jhu.edu", "faculty@jhu.edu"},
+		},
+		"unscoped fallback": {
+			headers: map[string][]string{
+				"Unscoped-Affiliation": {"staff;member"},
+			},
+			expected: []string{"staff", "member"},
+		},
+		"scoped preferred": {
+			headers: map[string][]string{
+				"Affiliation":          {"staff@jhu.edu"},
+				"Unscoped-Affiliation": {"staff"},
+			},
+			expected: []string{"staff@jhu.edu"},
+		},
+		"strip scope": {
+			policy: jhuda.AffiliationPolicy{StripScope: true},
+			headers: map[string][]string{
+				"Affiliation": {"staff@jhu.edu;staff@jhmi.edu;student@jhu.edu"},
+			},
+			expected: []string{"staff", "student"},
+		},
+		"allowed vocabulary": {
+			policy: jhuda.AffiliationPolicy{Allowed: []string{"Faculty", "staff"}},
+			headers: map[string][]string{
+				"Affiliation": {"STAFF@jhu.edu;library-walk-in@jhu.edu;faculty@jhmi.edu;bogus"},
+			},
+			expected: []string{"STAFF@jhu.edu", "faculty@jhmi.edu"},
+		},
+		"nothing allowed": {
+			policy: jhuda.AffiliationPolicy{Allowed: []string{"faculty"}},
+			headers: map[string][]string{
+				"Affiliation": {"staff@jhu.edu"},
+			},
+		},
+		"custom header": {
+			affiliationHeaders: []string{"Scoped-Affiliation"},
+			headers: map[string][]string{
+				"Scoped-Affiliation": {"member@jhu.edu"},
+				"Affiliation":        {"staff@jhu.edu"},
+			},
+			expected: []string{"member@jhu.edu"},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			tc.headers["Eppn"] = []string{"foo@example.org"}
+
+			user, err := jhuda.UserService{
+				HeaderDefs:  jhuda.ShibHeaders{Affiliation: tc.affiliationHeaders},
+				Affiliation: tc.policy,
+			}.FromHeaders(http.Header(tc.headers))
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+
+			diffs := deep.Equal(user.Affiliation, tc.expected)
+			if len(diffs) > 0 {
+				t.Fatalf("Did not get expected affiliations:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+func TestNameAndIdentifiers(t *testing.T) {
+	cases := map[string]struct {
+		service  jhuda.UserService
+		headers  map[string][]string
+		expected jhuda.User
+	}{
+		"default headers": {
+			headers: map[string][]string{
+				"Middlename": {"Q"},
+				"Uid":        {"jdoe1"},
+				"Orcid":      {"0000-0002-1825-0097"},
+			},
+			expected: jhuda.User{
+				Middlename: "Q",
+				Username:   "jdoe1",
+				OrcidID:    "https://orcid.org/0000-0002-1825-0097",
+			},
+		},
+		"custom headers": {
+			service: jhuda.UserService{
+				HeaderDefs: jhuda.ShibHeaders{
+					Middlename: "Middle",
+					Username:   "Login",
+					OrcidID:    "Eduperson-Orcid",
+				},
+			},
+			headers: map[string][]string{
+				"Middle":          {"Q"},
+				"Login":           {"jdoe1"},
+				"Eduperson-Orcid": {"http://orcid.org/0000-0002-1825-0097"},
+				"Uid":             {"ignored"},
+			},
+			expected: jhuda.User{
+				Middlename: "Q",
+				Username:   "jdoe1",
+				OrcidID:    "https://orcid.org/0000-0002-1825-0097",
+			},
+		},
+		"username from eppn": {
+			service: jhuda.UserService{EppnUsername: true},
+			expected: jhuda.User{
+				Username: "foo",
+			},
+		},
+		"username header preferred over eppn": {
+			service: jhuda.UserService{EppnUsername: true},
+			headers: map[string][]string{
+				"Uid": {"jdoe1"},
+			},
+			expected: jhuda.User{
+				Username: "jdoe1",
+			},
+		},
+		"no username": {},
+		"invalid orcid ignored": {
+			headers: map[string][]string{
+				"Orcid": {"0000-0002-1825-0098"},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			headers := http.Header{"Eppn": {"foo@example.org"}}
+			for k, v := range tc.headers {
+				headers[k] = v
+			}
+
+			user, err := tc.service.FromHeaders(headers)
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+
+			got := jhuda.User{
+				Middlename: user.Middlename,
+				Username:   user.Username,
+				OrcidID:    user.OrcidID,
+			}
+			diffs := deep.Equal(got, tc.expected)
+			if len(diffs) > 0 {
+				t.Fatalf("Did not get expected user:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+func TestLocatorFormat(t *testing.T) {
+	cases := map[string]struct {
+		format   jhuda.LocatorFormat
+		expected []string
+	}{
+		"default": {
+			expected: []string{
+				"jhu.edu:Employeenumber:000123",
+				"jhu.edu:unique-id:ABC@johnshopkins.edu",
+				"jhu.edu:Eppn:foo@jhu.edu",
+			},
+		},
+		"template": {
+			format: jhuda.LocatorFormat{Template: "urn:{name}:{value}@{domain}"},
+			expected: []string{
+				"urn:Employeenumber:000123@jhu.edu",
+				"urn:unique-id:ABC@johnshopkins.edu@jhu.edu",
+				"urn:Eppn:foo@jhu.edu@jhu.edu",
+			},
+		},
+		"scoped": {
+			format: jhuda.LocatorFormat{Scoped: []string{"Unique-Id", "Employeenumber"}},
+			expected: []string{
+				"jhu.edu:Employeenumber:000123",
+				"johnshopkins.edu:unique-id:ABC",
+				"jhu.edu:Eppn:foo@jhu.edu",
+			},
+		},
+		"aliases": {
+			format: jhuda.LocatorFormat{Aliases: map[string]string{"employeenumber": "employeeid", "unique-id": "uid"}},
+			expected: []string{
+				"jhu.edu:employeeid:000123",
+				"jhu.edu:uid:ABC@johnshopkins.edu",
+				"jhu.edu:Eppn:foo@jhu.edu",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			user, err := jhuda.UserService{Locators: tc.format}.FromHeaders(http.Header{
+				"Eppn":           {"foo@jhu.edu"},
+				"Employeenumber": {"000123"},
+				"Unique-Id":      {"ABC@johnshopkins.edu"},
+			})
+			if err != nil {
+				t.Fatalf("Got unexpected error: %v", err)
+			}
+
+			diffs := deep.Equal(user.Locatorids, tc.expected)
+			if len(diffs) > 0 {
+				t.Fatalf("Did not get expected locators:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
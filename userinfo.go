@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultClaims map standard OpenID Connect claims to the User properties
+// they are given by
+var DefaultClaims = map[string]string{
+	"sub":                "@id",
+	"name":               "displayName",
+	"given_name":         "firstName",
+	"middle_name":        "middleName",
+	"family_name":        "lastName",
+	"preferred_username": "username",
+	"email":              "email",
+	"groups":             "groups",
+	"roles":              "roles",
+}
+
+// ClaimMapping configures the claims given by the /userinfo endpoint, as the
+// User property each is given by, e.g.
+//
+//	{"claims": {"sub": "eppn", "orcid": "orcidId", "groups": "roles", "middle_name": ""}}
+//
+// Claims are added to, or replace, the DefaultClaims.  Claims mapped to an
+// empty property are not given.
+type ClaimMapping struct {
+	Claims map[string]string `json:"claims"`
+}
+
+// claimProperties are the User properties that claims may be given by
+var claimProperties = map[string]func(u *User) interface{}{
+	"@id":              func(u *User) interface{} { return u.ID },
+	"eppn":             func(u *User) interface{} { return u.Eppn },
+	"identityProvider": func(u *User) interface{} { return u.IdentityProvider },
+	"username":         func(u *User) interface{} { return u.Username },
+	"firstName":        func(u *User) interface{} { return u.Firstname },
+	"middleName":       func(u *User) interface{} { return u.Middlename },
+	"lastName":         func(u *User) interface{} { return u.Lastname },
+	"displayName":      func(u *User) interface{} { return u.Displayname },
+	"email":            func(u *User) interface{} { return u.Email },
+	"orcidId":          func(u *User) interface{} { return u.OrcidID },
+	"affiliation":      func(u *User) interface{} { return u.Affiliation },
+	"locatorIds":       func(u *User) interface{} { return u.Locatorids },
+	"groups":           func(u *User) interface{} { return u.Groups },
+	"roles":            func(u *User) interface{} { return u.Roles },
+}
+
+// LoadClaimMapping reads a JSON claim mapping from the given file
+func LoadClaimMapping(path string) (*ClaimMapping, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open claim mapping file")
+	}
+	defer f.Close()
+
+	mapping, err := ReadClaimMapping(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read claim mapping file %s", path)
+	}
+
+	return mapping, nil
+}
+
+// ReadClaimMapping decodes and validates a JSON claim mapping
+func ReadClaimMapping(r io.Reader) (*ClaimMapping, error) {
+	var mapping ClaimMapping
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&mapping); err != nil {
+		return nil, errors.Wrapf(err, "malformed claim mapping")
+	}
+
+	if err := mapping.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &mapping, nil
+}
+
+// Validate checks that every claim is given by a known property, and that
+// there is a subject
+func (m *ClaimMapping) Validate() error {
+	claims := m.claims()
+	if claims["sub"] == "" {
+		return errors.Errorf("the sub claim must be given by a property")
+	}
+
+	for _, claim := range sortedKeys(claims) {
+		if _, ok := claimProperties[claims[claim]]; !ok && claims[claim] != "" {
+			return errors.Errorf("claim %s is given by unknown property '%s'", claim, claims[claim])
+		}
+	}
+
+	return nil
+}
+
+// UserInfo gives the user's claims.  Claims with empty values are omitted,
+// except the subject.
+func (m *ClaimMapping) UserInfo(u *User) map[string]interface{} {
+	info := map[string]interface{}{}
+
+	for claim, property := range m.claims() {
+		value, ok := claimProperties[property]
+		if !ok {
+			continue
+		}
+
+		switch v := value(u).(type) {
+		case string:
+			if v != "" || claim == "sub" {
+				info[claim] = v
+			}
+		case []string:
+			if len(v) > 0 {
+				info[claim] = v
+			}
+		}
+	}
+
+	return info
+}
+
+// claims gives the default claims, replaced by any mapped
+func (m *ClaimMapping) claims() map[string]string {
+	claims := map[string]string{}
+	for claim, property := range DefaultClaims {
+		claims[claim] = property
+	}
+
+	if m != nil {
+		for claim, property := range m.Claims {
+			claims[claim] = property
+		}
+	}
+
+	return claims
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
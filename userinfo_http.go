@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// httpUserInfoService responds with the claims of the user identified by the
+// request's headers, as an OpenID Connect userinfo endpoint would
+func httpUserInfoService(svc userProvider, claims *ClaimMapping) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, err := svc.FromHeaders(r.Header)
+		if err != nil {
+			writeProblem(w, errorProblem(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(claims.UserInfo(user)); err != nil {
+			log.Printf("Error encoding JSON response %v", err)
+		}
+	})
+}
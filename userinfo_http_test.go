@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestUserInfoResponse(t *testing.T) {
+	provider := FakeUserProvider(func() (*User, error) {
+		return &User{ID: "foo:/bar", Email: "foo@example.org", Roles: []string{"admin"}}, nil
+	})
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		resp := httptest.NewRecorder()
+		httpUserInfoService(provider, nil).ServeHTTP(resp, httptest.NewRequest(method, "/userinfo", nil))
+
+		if resp.Code != http.StatusOK || !strings.Contains(resp.Header().Get("Content-Type"), "application/json") {
+			t.Fatalf("Got response code %d, %s", resp.Code, resp.Header().Get("Content-Type"))
+		}
+
+		var claims map[string]interface{}
+		if err := json.Unmarshal(resp.Body.Bytes(), &claims); err != nil {
+			t.Fatalf("Malformed response: %v", err)
+		}
+
+		expected := map[string]interface{}{
+			"sub":   "foo:/bar",
+			"email": "foo@example.org",
+			"roles": []interface{}{"admin"},
+		}
+		if diffs := deep.Equal(claims, expected); len(diffs) > 0 {
+			t.Fatalf("Wrong claims:\n%s", strings.Join(diffs, "\n"))
+		}
+	}
+}
+
+func TestUserInfoErrors(t *testing.T) {
+	resp := httptest.NewRecorder()
+	httpUserInfoService(FakeUserProvider(func() (*User, error) {
+		return nil, ErrorMissingIdentity("Who?")
+	}), nil).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/userinfo", nil))
+
+	if resp.Code != http.StatusUnauthorized || resp.Header().Get("Content-Type") != ProblemContentType {
+		t.Fatalf("Got response code %d, %s", resp.Code, resp.Header().Get("Content-Type"))
+	}
+
+	resp = httptest.NewRecorder()
+	httpUserInfoService(nil, nil).ServeHTTP(resp, httptest.NewRequest(http.MethodDelete, "/userinfo", nil))
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Method should not be allowed, got %d", resp.Code)
+	}
+}
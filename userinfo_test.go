@@ -0,0 +1,98 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	jhuda "github.com/jhu-sheridan-libraries/jhuda-user-service"
+)
+
+func TestUserInfo(t *testing.T) {
+	user := &jhuda.User{
+		ID:          "http://example.org/users/bossman@jhu.edu",
+		Eppn:        "bossman@jhu.edu",
+		Username:    "bossman",
+		Firstname:   "Boss",
+		Middlename:  "The",
+		Lastname:    "Man",
+		Displayname: "Boss Man",
+		Email:       "bossman@jhu.edu",
+		OrcidID:     "https://orcid.org/0000-0002-1825-0097",
+		Groups:      []string{"staff"},
+		Roles:       []string{"submitter", "admin"},
+	}
+
+	configured, err := jhuda.LoadClaimMapping("testdata/claims.json")
+	if err != nil {
+		t.Fatalf("Could not load claim mapping: %v", err)
+	}
+
+	cases := map[string]struct {
+		claims   *jhuda.ClaimMapping
+		user     *jhuda.User
+		expected map[string]interface{}
+	}{
+		"defaults": {
+			user: user,
+			expected: map[string]interface{}{
+				"sub":                "http://example.org/users/bossman@jhu.edu",
+				"name":               "Boss Man",
+				"given_name":         "Boss",
+				"middle_name":        "The",
+				"family_name":        "Man",
+				"preferred_username": "bossman",
+				"email":              "bossman@jhu.edu",
+				"groups":             []string{"staff"},
+				"roles":              []string{"submitter", "admin"},
+			},
+		},
+		"configured": {
+			claims: configured,
+			user:   user,
+			expected: map[string]interface{}{
+				"sub":                "bossman@jhu.edu",
+				"name":               "Boss Man",
+				"given_name":         "Boss",
+				"family_name":        "Man",
+				"preferred_username": "bossman",
+				"email":              "bossman@jhu.edu",
+				"orcid":              "https://orcid.org/0000-0002-1825-0097",
+				"groups":             []string{"submitter", "admin"},
+			},
+		},
+		"empty values omitted": {
+			user: &jhuda.User{ID: "foo"},
+			expected: map[string]interface{}{
+				"sub": "foo",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			if diffs := deep.Equal(tc.claims.UserInfo(tc.user), tc.expected); len(diffs) > 0 {
+				t.Fatalf("Wrong claims:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+func TestBadClaimMapping(t *testing.T) {
+	cases := map[string]string{
+		"unknown property": `{"claims": {"name": "fullName"}}`,
+		"no subject":       `{"claims": {"sub": ""}}`,
+		"unknown field":    `{"claim": {"name": "displayName"}}`,
+		"malformed":        `{"claims": ["name"]}`,
+	}
+
+	for name, json := range cases {
+		json := json
+		t.Run(name, func(t *testing.T) {
+			if _, err := jhuda.ReadClaimMapping(strings.NewReader(json)); err == nil {
+				t.Fatalf("Expected an error reading the claim mapping")
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	// DefaultMaxHeaderLength is the default maximum length of header values.
+	// Group headers may be long, so this is generous.
+	DefaultMaxHeaderLength = 16384
+
+	// maxEppnLength is the maximum length of an eppn
+	maxEppnLength = 256
+)
+
+var (
+	// eppnPattern is user@scope, where scope is a DNS domain
+	eppnPattern = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+/=?^_{|}~.-]+@[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?(?:\.[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
+	// emailPattern is a deliberately loose check of an e-mail address
+	emailPattern = regexp.MustCompile(`^[^\s@]+@[^\s@]+\.[^\s@.]+$`)
+)
+
+// checkedHeaders checks the length and content of each header value it
+// provides, keeping the first problem found
+type checkedHeaders struct {
+	headers   HeaderProvider
+	maxLength int
+	err       error
+}
+
+func (c *checkedHeaders) Get(key string) string {
+	val := c.headers.Get(key)
+	if c.err != nil {
+		return val
+	}
+
+	if len(val) > c.maxLength {
+		c.err = ErrorBadInput(fmt.Sprintf("Header %s is longer than %d characters", key, c.maxLength))
+	} else if i := strings.IndexFunc(val, unicode.IsControl); i >= 0 {
+		c.err = ErrorBadInput(fmt.Sprintf("Header %s contains a control character at %d", key, i))
+	}
+
+	return val
+}
+
+// validateEppn checks the eppn is present and well formed
+func validateEppn(eppn, header string) error {
+	if eppn == "" {
+		return ErrorMissingIdentity(fmt.Sprintf("No eppn in header %s", header))
+	}
+
+	if len(eppn) > maxEppnLength || !eppnPattern.MatchString(eppn) {
+		return ErrorBadInput(fmt.Sprintf("Eppn is expected to be user@domain, instead got '%s'", eppn))
+	}
+
+	return nil
+}
+
+// validateEmail checks the e-mail address, if any, is well formed
+func validateEmail(email string) error {
+	if email != "" && !emailPattern.MatchString(email) {
+		return ErrorBadInput(fmt.Sprintf("Malformed e-mail address '%s'", email))
+	}
+
+	return nil
+}